@@ -0,0 +1,547 @@
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// imageExporter copies images from blob sources into an OCI layout dir, and
+// saves it as an OCI layout or a docker-archive
+type imageExporter struct {
+	dir    string
+	layout *ociLayoutWriter
+	refs   []Descriptor
+	images []dockerArchiveImage
+	// manifests are the indexes of images, keyed by manifest digest
+	manifests map[string]int
+}
+
+func newImageExporter(dir string) (exporter *imageExporter, err error) {
+	os.RemoveAll(dir)
+
+	var layout *ociLayoutWriter
+	if layout, err = newOCILayoutWriter(dir); err != nil {
+		return
+	}
+
+	exporter = &imageExporter{
+		dir:       dir,
+		layout:    layout,
+		manifests: map[string]int{},
+	}
+
+	return
+}
+
+// add copies the image or the manifest list of desc, it is named ref
+func (p *imageExporter) add(source BlobSource, ref string, desc Descriptor) (err error) {
+	if err = p.copyImage(source, desc, ref); err != nil {
+		return
+	}
+
+	p.addRef(ref, desc)
+
+	return
+}
+
+// addIndex copies the images of platforms, and writes a manifest list of
+// them named ref
+func (p *imageExporter) addIndex(source BlobSource, ref string, manifests []Descriptor) (err error) {
+	repo, tag := splitImageRef(ref)
+
+	index := Index{SchemaVersion: 2, MediaType: MediaTypeOCIIndex}
+
+	for i := 0; i < len(manifests); i++ {
+		desc := manifests[i]
+		desc.Annotations = nil
+
+		if err = p.copyImage(source, desc, repo+":"+platformTag(tag, descriptorPlatform(desc))); err != nil {
+			return
+		}
+
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	var desc Descriptor
+	if desc, err = p.layout.writeJSONBlob(MediaTypeOCIIndex, index); err != nil {
+		return
+	}
+
+	p.addRef(ref, desc)
+
+	return
+}
+
+func (p *imageExporter) addRef(ref string, desc Descriptor) {
+	desc.Annotations = map[string]string{AnnotationRefName: ref}
+	p.refs = append(p.refs, desc)
+}
+
+// copyImage copies the manifest of desc with its config and layers, the
+// manifests of a manifest list are copied as repoTag of their platforms
+func (p *imageExporter) copyImage(source BlobSource, desc Descriptor, repoTag string) (err error) {
+	var data []byte
+	if data, err = readBlob(source, desc.Digest); err != nil {
+		return
+	}
+
+	if isIndexMediaType(desc.MediaType) {
+		var index Index
+		if err = json.Unmarshal(data, &index); err != nil {
+			return
+		}
+
+		repo, tag := splitImageRef(repoTag)
+		for i := 0; i < len(index.Manifests); i++ {
+			if err = p.copyImage(source, index.Manifests[i], repo+":"+platformTag(tag, descriptorPlatform(index.Manifests[i]))); err != nil {
+				return
+			}
+		}
+
+		_, err = p.layout.writeBlob(desc.MediaType, data)
+
+		return
+	}
+
+	var manifest Manifest
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return
+	}
+
+	if err = p.layout.copyBlob(source, manifest.Config); err != nil {
+		return
+	}
+
+	for i := 0; i < len(manifest.Layers); i++ {
+		if err = p.layout.copyBlob(source, manifest.Layers[i]); err != nil {
+			return
+		}
+	}
+
+	if _, err = p.layout.writeBlob(desc.MediaType, data); err != nil {
+		return
+	}
+
+	i, exist := p.manifests[desc.Digest]
+	if !exist {
+		image := dockerArchiveImage{Config: blobArchivePath(manifest.Config.Digest)}
+		for j := 0; j < len(manifest.Layers); j++ {
+			image.Layers = append(image.Layers, blobArchivePath(manifest.Layers[j].Digest))
+		}
+
+		i = len(p.images)
+		p.images = append(p.images, image)
+		p.manifests[desc.Digest] = i
+	}
+
+	if len(repoTag) > 0 {
+		p.images[i].RepoTags = append(p.images[i].RepoTags, repoTag)
+	}
+
+	return
+}
+
+// save writes the images as format into output
+func (p *imageExporter) save(format, output string) (err error) {
+	if err = p.layout.writeIndex(p.refs); err != nil {
+		return
+	}
+
+	os.RemoveAll(output)
+
+	if format == ImageFormatDockerArchive {
+		return writeDockerArchive(p.dir, output, p.images)
+	}
+
+	return os.Rename(p.dir, output)
+}
+
+// descriptorPlatform is the platform of a manifest in a manifest list
+func descriptorPlatform(desc Descriptor) *Platform {
+	if desc.Platform == nil {
+		return nil
+	}
+	return &Platform{OS: desc.Platform.OS, Arch: desc.Platform.Architecture, Variant: desc.Platform.Variant}
+}
+
+// archivePath is where SaveImage writes images, <workdir>/<app>-image.tar
+// for docker-archive, <workdir>/<app>-image.oci for OCI layout
+func (p *Builder) archivePath() string {
+	if len(p.Options.ArchivePath) > 0 {
+		if filepath.IsAbs(p.Options.ArchivePath) {
+			return p.Options.ArchivePath
+		}
+		return filepath.Join(p.Options.WorkDir, p.Options.ArchivePath)
+	}
+
+	if p.Options.ImageFormat == ImageFormatDockerArchive {
+		return filepath.Join(p.Options.WorkDir, p.Options.AppName+"-image.tar")
+	}
+	return filepath.Join(p.Options.WorkDir, p.Options.AppName+"-image.oci")
+}
+
+// SaveImage saves the images of all tags into one docker-archive tarball or
+// OCI layout dir, it is like docker save with the tags of the revision,
+// multi platform images are saved as manifest lists in OCI layouts
+func (p *Builder) SaveImage() (err error) {
+	if err = p.initOptions(); err != nil {
+		return
+	}
+
+	if len(p.Options.RegistryOrg) == 0 {
+		err = errors.New("docker registry organization could not be empty")
+		return
+	}
+
+	if err = p.validateImageRefs(); err != nil {
+		return
+	}
+
+	var platforms []Platform
+	if platforms, err = p.targetPlatforms(); err != nil {
+		return
+	}
+
+	output := p.archivePath()
+	baseTagName := imageName(p.Options)
+
+	var source *ImageArchive
+
+	if p.Options.Engine == EngineNative {
+		// the image could be built in the other format
+		input := filepath.Join(p.outputDir(), nativeImageOCI)
+		if p.dryRun() {
+			input = p.nativeImagePath()
+		} else if _, e := os.Stat(input); e != nil {
+			input = filepath.Join(p.outputDir(), nativeImageArchive)
+		}
+
+		logger.Debugf("save %s as %s", input, output)
+
+		if p.dryRun() {
+			args := []string{"--format", p.Options.ImageFormat, "-o", output, "--from", input}
+			for i := 0; i < len(p.Options.AppImageTags); i++ {
+				args = append(args, baseTagName+":"+p.Options.AppImageTags[i])
+			}
+
+			p.Plan.addNativeStep("save", args...)
+			return
+		}
+
+		if source, err = OpenImageArchive(input); err != nil {
+			err = fmt.Errorf("open image of native engine failure, please build image first: %s", err)
+			return
+		}
+	} else {
+		var images []string
+		for i := 0; i < len(p.Options.AppImageTags); i++ {
+			if len(platforms) == 0 {
+				images = append(images, baseTagName+":"+p.Options.AppImageTags[i])
+				continue
+			}
+
+			for j := 0; j < len(platforms); j++ {
+				images = append(images, baseTagName+":"+platformTag(p.Options.AppImageTags[i], &platforms[j]))
+			}
+		}
+
+		// docker save writes a docker-archive, it is converted to the format
+		tmpArchive := output + ".docker.tar"
+		if p.dryRun() {
+			tmpArchive = output
+		}
+
+		logger.Debugf("docker save -o %s %s", tmpArchive, strings.Join(images, " "))
+
+		if err = p.Docker.SaveImage(images, tmpArchive); err != nil {
+			return
+		}
+
+		if p.dryRun() {
+			return
+		}
+
+		defer os.Remove(tmpArchive)
+
+		if source, err = OpenImageArchive(tmpArchive); err != nil {
+			return
+		}
+	}
+
+	var exporter *imageExporter
+	if exporter, err = newImageExporter(output + ".tmp"); err != nil {
+		return
+	}
+	defer os.RemoveAll(exporter.dir)
+
+	for i := 0; i < len(p.Options.AppImageTags); i++ {
+		ref := baseTagName + ":" + p.Options.AppImageTags[i]
+
+		if p.Options.Engine == EngineNative || len(platforms) == 0 {
+			var desc Descriptor
+			if desc, err = source.Select(p.Options.AppImageTags[i]); err != nil {
+				return
+			}
+
+			if err = exporter.add(source, ref, desc); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		var manifests []Descriptor
+		for j := 0; j < len(platforms); j++ {
+			var desc Descriptor
+			if desc, err = source.Select(baseTagName + ":" + platformTag(p.Options.AppImageTags[i], &platforms[j])); err != nil {
+				return
+			}
+
+			desc.Platform = &DescriptorPlatform{OS: platforms[j].OS, Architecture: platforms[j].Arch, Variant: platforms[j].Variant}
+			manifests = append(manifests, desc)
+		}
+
+		if err = exporter.addIndex(source, ref, manifests); err != nil {
+			return
+		}
+	}
+
+	if err = exporter.save(p.Options.ImageFormat, output); err != nil {
+		return
+	}
+
+	logger.Infof("images saved: %s", output)
+
+	return
+}
+
+// archiveImage is an image of an archive, and the ref it is loaded or
+// pushed as
+type archiveImage struct {
+	Desc   Descriptor
+	Ref    string
+	Target string
+}
+
+// archiveImages returns the named images of the archive, they are renamed
+// to the registry and organization of options if the organization is given,
+// e.g: registry.local/org/app:v1 of the archive is pushed as
+// mirror.local/myorg/app:v1 with --registry mirror.local --organization myorg,
+// mirror.local/org/app:v1 with --registry mirror.local only, or
+// registry.local/myorg/app:v1 with --organization myorg only
+func (p *Builder) archiveImages(archive *ImageArchive) (images []archiveImage, err error) {
+	for i := 0; i < len(archive.Manifests); i++ {
+		desc := archive.Manifests[i]
+
+		ref := descriptorRefName(desc)
+		if len(ref) == 0 {
+			continue
+		}
+
+		desc.Annotations = nil
+
+		repo, tag := splitImageRef(ref)
+
+		// a ref name of OCI layouts could be a tag only
+		if len(tag) == 0 && !strings.ContainsAny(ref, "/@") {
+			repo, tag = imageName(p.Options), ref
+		}
+
+		if len(tag) == 0 {
+			logger.Warnf("image %s of %s has no tag, skipped", ref, archive.Path)
+			continue
+		}
+
+		if len(p.Options.RegistryOrg) > 0 {
+			options := p.Options
+			if len(options.RegistryHost) == 0 {
+				options.RegistryHost, _ = splitRepository(repo)
+			}
+			options.AppName = repo[strings.LastIndex(repo, "/")+1:]
+			repo = imageName(options)
+		} else if len(p.Options.RegistryHost) > 0 {
+			_, name := splitRepository(repo)
+			repo = path.Join(p.Options.RegistryHost, name)
+		}
+
+		if err = ValidateRepository(repo); err != nil {
+			return
+		}
+
+		if err = ValidateTag(tag); err != nil {
+			return
+		}
+
+		images = append(images, archiveImage{Desc: desc, Ref: ref, Target: repo + ":" + tag})
+	}
+
+	if len(images) == 0 {
+		err = fmt.Errorf("there is no named image in %s", archive.Path)
+		return
+	}
+
+	return
+}
+
+// LoadImage loads the images of Options.ArchivePath, a docker-archive or an
+// OCI layout saved by SaveImage, into docker
+func (p *Builder) LoadImage() (err error) {
+	if err = p.initOptions(); err != nil {
+		return
+	}
+
+	if len(p.Options.ArchivePath) == 0 {
+		err = errors.New("the archive of images to load could not be empty")
+		return
+	}
+
+	input := p.archivePath()
+
+	if p.dryRun() {
+		return p.Docker.LoadImage(input)
+	}
+
+	var archive *ImageArchive
+	if archive, err = OpenImageArchive(input); err != nil {
+		return
+	}
+
+	var images []archiveImage
+	if images, err = p.archiveImages(archive); err != nil {
+		return
+	}
+
+	// re-export as a docker-archive, docker load does not know OCI layouts,
+	// and manifest lists are loaded as the images of their platforms
+	var tmpDir string
+	if tmpDir, err = ioutil.TempDir("", "go-to-docker-load"); err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var exporter *imageExporter
+	if exporter, err = newImageExporter(filepath.Join(tmpDir, "layout")); err != nil {
+		return
+	}
+
+	for i := 0; i < len(images); i++ {
+		logger.Debugf("load %s as %s", images[i].Ref, images[i].Target)
+
+		if err = exporter.add(archive, images[i].Target, images[i].Desc); err != nil {
+			return
+		}
+	}
+
+	tmpArchive := filepath.Join(tmpDir, nativeImageArchive)
+	if err = exporter.save(ImageFormatDockerArchive, tmpArchive); err != nil {
+		return
+	}
+
+	return p.Docker.LoadImage(tmpArchive)
+}
+
+// PushArchive pushes the images of Options.ArchivePath to the registry by
+// the registry api, without docker
+func (p *Builder) PushArchive() (err error) {
+	if err = p.initOptions(); err != nil {
+		return
+	}
+
+	if len(p.Options.ArchivePath) == 0 {
+		err = errors.New("the archive of images to push could not be empty")
+		return
+	}
+
+	if err = p.resolveRegistryAuth(os.Getenv); err != nil {
+		return
+	}
+
+	input := p.archivePath()
+
+	if p.dryRun() {
+		// the archive may be saved by this dry run, so it is not read
+		args := []string{"--from", input}
+		if len(p.Options.RegistryHost) > 0 {
+			args = append(args, "--registry", p.Options.RegistryHost)
+		}
+		if len(p.Options.RegistryOrg) > 0 {
+			args = append(args, "--organization", p.Options.RegistryOrg)
+		}
+
+		p.Plan.addNativeStep("push", args...)
+		return
+	}
+
+	var archive *ImageArchive
+	if archive, err = OpenImageArchive(input); err != nil {
+		return
+	}
+
+	var images []archiveImage
+	if images, err = p.archiveImages(archive); err != nil {
+		return
+	}
+
+	clients := map[string]*RegistryClient{}
+
+	for i := 0; i < len(images); i++ {
+		host, repo, tag, _ := parseImageReference(images[i].Target)
+
+		client, exist := clients[host]
+		if !exist {
+			var auth RegistryAuth
+			if auth, err = p.registryAuth(host); err != nil {
+				return
+			}
+
+			if client, err = NewRegistryClient(host, auth); err != nil {
+				return
+			}
+
+			clients[host] = client
+		}
+
+		var digest string
+		if digest, err = client.PushImage(repo, tag, images[i].Desc, archive); err != nil {
+			return
+		}
+
+		logger.Debugf("image pushed: %s@%s", images[i].Target, digest)
+
+		if p.ImageDigests == nil {
+			p.ImageDigests = map[string]string{}
+		}
+		p.ImageDigests[images[i].Target] = digest
+	}
+
+	return
+}
+
+// registryAuth returns the auth of options for its registry, the auth of
+// other registries is looked up in the docker config
+func (p *Builder) registryAuth(host string) (auth RegistryAuth, err error) {
+	server := p.Options.RegistryHost
+	if len(server) == 0 {
+		server = dockerHubServer
+	}
+
+	if registryHostname(host) == registryHostname(server) {
+		auth = RegistryAuth{
+			Username:      p.Options.RegistryUsername,
+			Password:      p.Options.RegistryPassword,
+			ServerAddress: p.Options.RegistryHost,
+			IdentityToken: p.Options.RegistryIdentityToken,
+		}
+		return
+	}
+
+	auth, _, err = lookupDockerCredentials(host, os.Getenv)
+
+	return
+}
@@ -0,0 +1,320 @@
+package builder
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeImageLayout writes blobs and an index.json of manifests as an OCI
+// image layout dir
+func writeImageLayout(t *testing.T, dir string, blobs memoryBlobs, manifests []Descriptor) {
+	layout, err := newOCILayoutWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range blobs {
+		if _, err = layout.writeBlob("", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = layout.writeIndex(manifests); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func annotated(desc Descriptor, annotations map[string]string) Descriptor {
+	desc.Annotations = annotations
+	return desc
+}
+
+func TestImageArchiveSelect(t *testing.T) {
+	blobs := memoryBlobs{}
+	v1 := blobs.addImage(t, "amd64", "v1")
+	v2 := blobs.addImage(t, "amd64", "v2")
+	v3 := blobs.addImage(t, "amd64", "v3")
+
+	manifests := []Descriptor{
+		// docker save of docker 25+
+		annotated(v1, map[string]string{AnnotationRefName: "v1", AnnotationContainerdImageName: "docker.io/gogap/app:v1"}),
+		// docker save of older docker
+		annotated(v2, map[string]string{AnnotationRefName: "registry.example.com/gogap/app:v2"}),
+		// OCI layouts of tags only
+		annotated(v3, map[string]string{AnnotationRefName: "v3"}),
+		annotated(v1, map[string]string{AnnotationRefName: "v4"}),
+		annotated(v2, map[string]string{AnnotationRefName: "v4"}),
+	}
+
+	tests := []struct {
+		name       string
+		ref        string
+		wantDigest string
+		wantErr    string
+	}{
+		{
+			name:       "containerd image name",
+			ref:        "gogap/app:v1",
+			wantDigest: v1.Digest,
+		},
+		{
+			name:       "tag of containerd image name",
+			ref:        "v1",
+			wantDigest: v1.Digest,
+		},
+		{
+			name:       "repo tag",
+			ref:        "registry.example.com/gogap/app:v2",
+			wantDigest: v2.Digest,
+		},
+		{
+			name:       "tag of repo tag",
+			ref:        "v2",
+			wantDigest: v2.Digest,
+		},
+		{
+			name:       "ref name of tag",
+			ref:        "registry.example.com/gogap/app:v3",
+			wantDigest: v3.Digest,
+		},
+		{
+			name:    "ambiguous tag",
+			ref:     "gogap/app:v4",
+			wantErr: "ambiguous",
+		},
+		{
+			name:    "not found",
+			ref:     "gogap/app:v5",
+			wantErr: "not found",
+		},
+		{
+			name:    "other repository",
+			ref:     "gogap/other:v2",
+			wantErr: "not found",
+		},
+	}
+
+	archive := &ImageArchive{Path: "app.oci", Manifests: manifests}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			desc, err := archive.Select(test.ref)
+			if checkErr(t, err, test.wantErr) {
+				return
+			}
+
+			if desc.Digest != test.wantDigest {
+				t.Errorf("selected %s, want %s", desc.Digest, test.wantDigest)
+			}
+		})
+	}
+}
+
+func TestArchiveImages(t *testing.T) {
+	blobs := memoryBlobs{}
+	desc := blobs.addImage(t, "amd64", "app")
+
+	tests := []struct {
+		name        string
+		annotations []map[string]string
+		options     BuildOptions
+		wantTargets []string
+		wantErr     string
+	}{
+		{
+			name:        "as it is",
+			annotations: []map[string]string{{AnnotationRefName: "registry.local/org/app:v1"}},
+			wantTargets: []string{"registry.local/org/app:v1"},
+		},
+		{
+			name:        "registry and organization",
+			annotations: []map[string]string{{AnnotationRefName: "registry.local/org/app:v1"}},
+			options:     BuildOptions{RegistryHost: "mirror.local", RegistryOrg: "myorg"},
+			wantTargets: []string{"mirror.local/myorg/app:v1"},
+		},
+		{
+			name:        "registry only",
+			annotations: []map[string]string{{AnnotationRefName: "registry.local/org/app:v1"}},
+			options:     BuildOptions{RegistryHost: "mirror.local"},
+			wantTargets: []string{"mirror.local/org/app:v1"},
+		},
+		{
+			name:        "organization only",
+			annotations: []map[string]string{{AnnotationRefName: "registry.local/org/app:v1"}},
+			options:     BuildOptions{RegistryOrg: "myorg"},
+			wantTargets: []string{"registry.local/myorg/app:v1"},
+		},
+		{
+			name:        "organization only of docker hub",
+			annotations: []map[string]string{{AnnotationRefName: "org/app:v1"}},
+			options:     BuildOptions{RegistryOrg: "myorg"},
+			wantTargets: []string{"myorg/app:v1"},
+		},
+		{
+			name:        "containerd image name",
+			annotations: []map[string]string{{AnnotationRefName: "v1", AnnotationContainerdImageName: "registry.local/org/app:v1"}},
+			options:     BuildOptions{RegistryHost: "mirror.local"},
+			wantTargets: []string{"mirror.local/org/app:v1"},
+		},
+		{
+			name:        "tag only",
+			annotations: []map[string]string{{AnnotationRefName: "v1"}, {AnnotationRefName: "latest"}},
+			options:     BuildOptions{RegistryHost: "mirror.local", RegistryOrg: "myorg", AppName: "server"},
+			wantTargets: []string{"mirror.local/myorg/server:v1", "mirror.local/myorg/server:latest"},
+		},
+		{
+			name:        "unnamed images are skipped",
+			annotations: []map[string]string{nil, {AnnotationRefName: "org/app:v1"}},
+			wantTargets: []string{"org/app:v1"},
+		},
+		{
+			name:        "no named image",
+			annotations: []map[string]string{nil},
+			wantErr:     "there is no named image",
+		},
+		{
+			name:        "bad organization",
+			annotations: []map[string]string{{AnnotationRefName: "org/app:v1"}},
+			options:     BuildOptions{RegistryOrg: "my org"},
+			wantErr:     "invalid image repository",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			archive := &ImageArchive{Path: "app.oci"}
+			for j := 0; j < len(test.annotations); j++ {
+				archive.Manifests = append(archive.Manifests, annotated(desc, test.annotations[j]))
+			}
+
+			builder := &Builder{Options: test.options}
+
+			images, err := builder.archiveImages(archive)
+			if checkErr(t, err, test.wantErr) {
+				return
+			}
+
+			var targets []string
+			for j := 0; j < len(images); j++ {
+				targets = append(targets, images[j].Target)
+
+				if images[j].Desc.Digest != desc.Digest || images[j].Desc.Annotations != nil {
+					t.Errorf("descriptor of %s = %+v, want %s without annotations", images[j].Target, images[j].Desc, desc.Digest)
+				}
+			}
+
+			if !reflect.DeepEqual(targets, test.wantTargets) {
+				t.Errorf("targets = %q, want %q", targets, test.wantTargets)
+			}
+		})
+	}
+}
+
+// TestSaveLoadPushArchive saves the images of the native engine as a
+// docker-archive, then loads and pushes it renamed to another organization
+func TestSaveLoadPushArchive(t *testing.T) {
+	isolateEnv(t)
+
+	registry := &MemoryRegistry{}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := serverURL.Host
+
+	dir := t.TempDir()
+
+	blobs := memoryBlobs{}
+	desc := blobs.addImage(t, "amd64", "base", "app")
+
+	writeImageLayout(t, filepath.Join(dir, "_output_", nativeImageOCI), blobs, []Descriptor{
+		annotated(desc, map[string]string{AnnotationRefName: host + "/gogap/app:v1"}),
+		annotated(desc, map[string]string{AnnotationRefName: host + "/gogap/app:latest"}),
+	})
+
+	newBuilder := func(options BuildOptions) (*Builder, *RecordingDocker) {
+		docker := &RecordingDocker{}
+
+		options.WorkDir = dir
+		options.BuildTime = testBuildTime
+		options.ArchivePath = "app.tar"
+
+		return &Builder{Options: options, Runner: noGitRunner(), Docker: docker}, docker
+	}
+
+	saver, _ := newBuilder(BuildOptions{
+		RegistryHost: host,
+		RegistryOrg:  "gogap",
+		AppImageTags: []string{"v1", "latest"},
+		Engine:       EngineNative,
+		ImageFormat:  ImageFormatDockerArchive,
+	})
+
+	if err = saver.SaveImage(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := OpenImageArchive(filepath.Join(dir, "app.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for i := 0; i < len(archive.Manifests); i++ {
+		names = append(names, descriptorRefName(archive.Manifests[i]))
+	}
+	sort.Strings(names)
+
+	if want := []string{host + "/gogap/app:latest", host + "/gogap/app:v1"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("saved images = %q, want %q", names, want)
+	}
+
+	// the host of the archive is kept without --registry
+	loader, docker := newBuilder(BuildOptions{RegistryOrg: "myorg"})
+	if err = loader.LoadImage(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(docker.Loaded)
+	if want := []string{host + "/myorg/app:latest", host + "/myorg/app:v1"}; !reflect.DeepEqual(docker.Loaded, want) {
+		t.Errorf("loaded images = %q, want %q", docker.Loaded, want)
+	}
+
+	pusher, _ := newBuilder(BuildOptions{RegistryOrg: "myorg"})
+	if err = pusher.PushArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tag := range []string{"v1", "latest"} {
+		data, _, exist := registry.Manifest("myorg/app", tag)
+		if !exist {
+			t.Errorf("myorg/app:%s is not pushed", tag)
+			continue
+		}
+
+		if digest := pusher.ImageDigests[host+"/myorg/app:"+tag]; digest != digestOf(data) {
+			t.Errorf("digest of myorg/app:%s = %s, want %s", tag, digest, digestOf(data))
+		}
+	}
+
+	var manifest Manifest
+	if err = json.Unmarshal(blobs[desc.Digest], &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(manifest.Layers); i++ {
+		if _, exist := registry.Blob("myorg/app", manifest.Layers[i].Digest); !exist {
+			t.Errorf("layer %s is not pushed", manifest.Layers[i].Digest)
+		}
+	}
+}
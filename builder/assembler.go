@@ -0,0 +1,609 @@
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// engines of building images
+const (
+	// EngineDocker builds images by docker build with the Dockerfile template
+	EngineDocker = "docker"
+	// EngineNative assembles images without a docker daemon
+	EngineNative = "native"
+)
+
+// formats of images assembled by EngineNative
+const (
+	ImageFormatOCI           = "oci"
+	ImageFormatDockerArchive = "docker-archive"
+)
+
+const (
+	// ScratchImage is the empty base image
+	ScratchImage = "scratch"
+	// OCIImagePrefix prefixes base images of an OCI layout or image tarball,
+	// such as oci:./base
+	OCIImagePrefix = "oci:"
+	// nativeAppDir is where the app files are, the same as the default
+	// Dockerfile template
+	nativeAppDir = "/go/app"
+)
+
+// ImageConfig is the OCI image config, unknown fields of base images such as
+// os.version are kept as they are
+type ImageConfig struct {
+	Created      string         `json:"created,omitempty"`
+	Author       string         `json:"author,omitempty"`
+	Architecture string         `json:"architecture"`
+	OS           string         `json:"os"`
+	Variant      string         `json:"variant,omitempty"`
+	Config       ImageRunConfig `json:"config"`
+	RootFS       ImageRootFS    `json:"rootfs"`
+	History      []ImageHistory `json:"history,omitempty"`
+
+	unknown map[string]json.RawMessage
+}
+
+// ImageRunConfig is the config of containers, unknown fields of base images
+// such as Healthcheck, Shell and OnBuild are kept as they are
+type ImageRunConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+
+	unknown map[string]json.RawMessage
+}
+
+func (p *ImageConfig) UnmarshalJSON(data []byte) (err error) {
+	type imageConfig ImageConfig
+	if err = json.Unmarshal(data, (*imageConfig)(p)); err != nil {
+		return
+	}
+
+	p.unknown, err = unknownJSONFields(data, p)
+
+	return
+}
+
+func (p ImageConfig) MarshalJSON() ([]byte, error) {
+	type imageConfig ImageConfig
+	return marshalJSONWithFields(imageConfig(p), p.unknown)
+}
+
+func (p *ImageRunConfig) UnmarshalJSON(data []byte) (err error) {
+	type imageRunConfig ImageRunConfig
+	if err = json.Unmarshal(data, (*imageRunConfig)(p)); err != nil {
+		return
+	}
+
+	p.unknown, err = unknownJSONFields(data, p)
+
+	return
+}
+
+func (p ImageRunConfig) MarshalJSON() ([]byte, error) {
+	type imageRunConfig ImageRunConfig
+	return marshalJSONWithFields(imageRunConfig(p), p.unknown)
+}
+
+// unknownJSONFields returns the fields of the json object data which are
+// not the json fields of the struct v points to
+func unknownJSONFields(data []byte, v interface{}) (unknown map[string]json.RawMessage, err error) {
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+
+	t := reflect.TypeOf(v).Elem()
+
+	for name, value := range fields {
+		known := false
+		for i := 0; i < t.NumField() && !known; i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			// encoding/json matches fields case insensitively
+			known = len(tag) > 0 && strings.EqualFold(tag, name)
+		}
+
+		if known {
+			continue
+		}
+
+		if unknown == nil {
+			unknown = map[string]json.RawMessage{}
+		}
+		unknown[name] = value
+	}
+
+	return
+}
+
+// marshalJSONWithFields marshals v with the fields of unknown added
+func marshalJSONWithFields(v interface{}, unknown map[string]json.RawMessage) (data []byte, err error) {
+	if data, err = json.Marshal(v); err != nil || len(unknown) == 0 {
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+
+	for name, value := range unknown {
+		if _, exist := fields[name]; !exist {
+			fields[name] = value
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+type ImageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ImageHistory struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// ImageAssembler assembles images of go binaries without a docker daemon,
+// like ko: the base image is pulled by the registry api or read from an
+// OCI layout, a layer of the app files is appended, and the config is set
+type ImageAssembler struct {
+	// Base is the base image, such as alpine:3.8, scratch or oci:<path>
+	Base string
+	// BaseAuth is used for base images of the registry BaseAuth.ServerAddress
+	BaseAuth RegistryAuth
+	// AppDir is where the app files are in the image
+	AppDir       string
+	Entrypoint   []string
+	User         string
+	Labels       map[string]string
+	ExposedPorts []string
+	Created      time.Time
+	// Exclude are the names of files in the context dir which are not added
+	Exclude []string
+	// Annotations are the annotations of the image manifest
+	Annotations map[string]string
+}
+
+// baseImage is the resolved base image of a platform
+type baseImage struct {
+	manifest Manifest
+	config   ImageConfig
+	source   BlobSource
+}
+
+// Assemble writes the image of the files in contextDir to layout, and
+// returns the descriptor of its manifest
+func (p *ImageAssembler) Assemble(layout *ociLayoutWriter, contextDir string, platform Platform) (desc Descriptor, manifest Manifest, err error) {
+	var base baseImage
+	if base, err = p.baseImage(platform); err != nil {
+		return
+	}
+
+	manifest = Manifest{SchemaVersion: 2, MediaType: MediaTypeOCIManifest, Annotations: p.Annotations}
+
+	for i := 0; i < len(base.manifest.Layers); i++ {
+		layer := base.manifest.Layers[i]
+		if err = layout.copyBlob(base.source, layer); err != nil {
+			err = fmt.Errorf("copy layer %s of base image %s failure: %s", layer.Digest, p.Base, err)
+			return
+		}
+
+		// docker and OCI gzip layers are the same bytes
+		if layer.MediaType == MediaTypeDockerLayerGzip {
+			layer.MediaType = MediaTypeOCILayerGzip
+		}
+
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+
+	var appLayer Descriptor
+	var diffID string
+	if appLayer, diffID, err = p.writeAppLayer(layout, contextDir); err != nil {
+		return
+	}
+
+	manifest.Layers = append(manifest.Layers, appLayer)
+
+	config := p.imageConfig(base.config, platform, diffID)
+
+	if manifest.Config, err = layout.writeJSONBlob(MediaTypeOCIConfig, config); err != nil {
+		return
+	}
+
+	if desc, err = layout.writeJSONBlob(MediaTypeOCIManifest, manifest); err != nil {
+		return
+	}
+
+	desc.Platform = &DescriptorPlatform{OS: platform.OS, Architecture: platform.Arch, Variant: platform.Variant}
+
+	return
+}
+
+func (p *ImageAssembler) imageConfig(config ImageConfig, platform Platform, diffID string) ImageConfig {
+	created := p.Created.UTC().Format(time.RFC3339)
+
+	config.Created = created
+	config.OS = platform.OS
+	config.Architecture = platform.Arch
+	config.Variant = platform.Variant
+
+	// ENTRYPOINT resets the CMD of base image
+	config.Config.Entrypoint = p.Entrypoint
+	config.Config.Cmd = nil
+	config.Config.WorkingDir = p.appDir()
+
+	if len(p.User) > 0 {
+		config.Config.User = p.User
+	}
+
+	if len(p.Labels) > 0 && config.Config.Labels == nil {
+		config.Config.Labels = map[string]string{}
+	}
+
+	for k, v := range p.Labels {
+		config.Config.Labels[k] = v
+	}
+
+	for i := 0; i < len(p.ExposedPorts); i++ {
+		if config.Config.ExposedPorts == nil {
+			config.Config.ExposedPorts = map[string]struct{}{}
+		}
+
+		port := p.ExposedPorts[i]
+		if !strings.Contains(port, "/") {
+			port += "/tcp"
+		}
+		config.Config.ExposedPorts[port] = struct{}{}
+	}
+
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	config.History = append(config.History, ImageHistory{
+		Created:   created,
+		CreatedBy: "go-to-docker",
+		Comment:   "app files in " + p.appDir(),
+	})
+
+	return config
+}
+
+func (p *ImageAssembler) appDir() string {
+	if len(p.AppDir) == 0 {
+		return nativeAppDir
+	}
+	return p.AppDir
+}
+
+// baseImage resolves the manifest and config of the base image of platform
+func (p *ImageAssembler) baseImage(platform Platform) (base baseImage, err error) {
+	if p.Base == ScratchImage {
+		return
+	}
+
+	var getManifest func(ref string) ([]byte, string, error)
+	var ref string
+
+	if strings.HasPrefix(p.Base, OCIImagePrefix) {
+		var archive *ImageArchive
+		if archive, err = OpenImageArchive(strings.TrimPrefix(p.Base, OCIImagePrefix)); err != nil {
+			return
+		}
+
+		var desc Descriptor
+		if desc, err = archive.Select(""); err != nil {
+			return
+		}
+
+		ref = desc.Digest
+		base.source = archive
+		getManifest = func(digest string) (data []byte, mediaType string, err error) {
+			data, err = readBlob(archive, digest)
+			return
+		}
+	} else {
+		host, repo, tag, digest := parseImageReference(p.Base)
+
+		auth := p.BaseAuth
+		if registryHostname(auth.ServerAddress) != registryHostname(host) {
+			if auth, _, err = lookupDockerCredentials(host, os.Getenv); err != nil {
+				return
+			}
+		}
+
+		var client *RegistryClient
+		if client, err = NewRegistryClient(host, auth); err != nil {
+			return
+		}
+
+		ref = tag
+		if len(digest) > 0 {
+			ref = digest
+		}
+
+		base.source = client.Blobs(repo)
+		getManifest = func(ref string) ([]byte, string, error) {
+			return client.GetManifest(repo, ref)
+		}
+	}
+
+	var data []byte
+	var mediaType string
+	if data, mediaType, err = getManifest(ref); err != nil {
+		err = fmt.Errorf("get manifest of base image %s failure: %s", p.Base, err)
+		return
+	}
+
+	if len(mediaType) == 0 || !isIndexMediaType(mediaType) && !isManifestMediaType(mediaType) {
+		var header struct {
+			MediaType string `json:"mediaType"`
+			Manifests []Descriptor
+		}
+		json.Unmarshal(data, &header)
+
+		mediaType = header.MediaType
+		if len(mediaType) == 0 && header.Manifests != nil {
+			mediaType = MediaTypeOCIIndex
+		}
+	}
+
+	if isIndexMediaType(mediaType) {
+		var index Index
+		if err = json.Unmarshal(data, &index); err != nil {
+			return
+		}
+
+		var desc Descriptor
+		if desc, err = matchPlatform(index.Manifests, platform); err != nil {
+			err = fmt.Errorf("base image %s: %s", p.Base, err)
+			return
+		}
+
+		if data, _, err = getManifest(desc.Digest); err != nil {
+			return
+		}
+	}
+
+	if err = json.Unmarshal(data, &base.manifest); err != nil {
+		err = fmt.Errorf("parse manifest of base image %s failure: %s", p.Base, err)
+		return
+	}
+
+	var configData []byte
+	if configData, err = readBlob(base.source, base.manifest.Config.Digest); err != nil {
+		err = fmt.Errorf("read config of base image %s failure: %s", p.Base, err)
+		return
+	}
+
+	if err = json.Unmarshal(configData, &base.config); err != nil {
+		err = fmt.Errorf("parse config of base image %s failure: %s", p.Base, err)
+		return
+	}
+
+	if base.config.OS != platform.OS || base.config.Architecture != platform.Arch {
+		logger.Warnf("base image %s is %s/%s, not %s", p.Base, base.config.OS, base.config.Architecture, platform)
+	}
+
+	return
+}
+
+// matchPlatform returns the manifest of platform in an index, the variant
+// is matched only if platform has one
+func matchPlatform(manifests []Descriptor, platform Platform) (desc Descriptor, err error) {
+	for i := 0; i < len(manifests); i++ {
+		mp := manifests[i].Platform
+		if mp == nil || mp.OS != platform.OS || mp.Architecture != platform.Arch {
+			continue
+		}
+
+		if len(platform.Variant) > 0 && mp.Variant != platform.Variant {
+			continue
+		}
+
+		desc = manifests[i]
+		return
+	}
+
+	err = fmt.Errorf("no image of platform %s", platform)
+
+	return
+}
+
+// writeAppLayer writes the gzipped tar of contextDir under AppDir as a
+// blob, and returns it with the digest of the uncompressed tar
+func (p *ImageAssembler) writeAppLayer(layout *ociLayoutWriter, contextDir string) (desc Descriptor, diffID string, err error) {
+	var w *blobWriter
+	if w, err = layout.newBlobWriter(); err != nil {
+		return
+	}
+
+	diffHash := sha256.New()
+	gw := gzip.NewWriter(w)
+
+	if err = p.tarAppDir(io.MultiWriter(gw, diffHash), contextDir); err != nil {
+		w.abort()
+		return
+	}
+
+	if err = gw.Close(); err != nil {
+		w.abort()
+		return
+	}
+
+	if desc, err = w.commit(MediaTypeOCILayerGzip); err != nil {
+		return
+	}
+
+	diffID = fmt.Sprintf("sha256:%x", diffHash.Sum(nil))
+
+	return
+}
+
+// tarAppDir writes the files of contextDir into AppDir of a tar, owned by
+// User if it is a numeric uid[:gid], with mtime of Created so that the
+// layer is reproducible
+func (p *ImageAssembler) tarAppDir(w io.Writer, contextDir string) (err error) {
+	tw := tar.NewWriter(w)
+
+	uid, gid := numericUser(p.User)
+	modTime := p.Created.UTC()
+
+	exclude := map[string]bool{}
+	for i := 0; i < len(p.Exclude); i++ {
+		exclude[p.Exclude[i]] = true
+	}
+
+	appDir := strings.Trim(path.Clean(p.appDir()), "/")
+
+	// the parent dirs of app dir
+	parts := strings.Split(appDir, "/")
+	for i := 0; i < len(parts); i++ {
+		hdr := &tar.Header{
+			Name:     strings.Join(parts[:i+1], "/") + "/",
+			Mode:     0755,
+			Typeflag: tar.TypeDir,
+			ModTime:  modTime,
+		}
+
+		if i == len(parts)-1 {
+			hdr.Uid, hdr.Gid = uid, gid
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return
+		}
+	}
+
+	var names []string
+	err = filepath.Walk(contextDir, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(contextDir, filename)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if exclude[filepath.ToSlash(rel)] {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		names = append(names, rel)
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	sort.Strings(names)
+
+	for i := 0; i < len(names); i++ {
+		filename := filepath.Join(contextDir, names[i])
+
+		var fi os.FileInfo
+		if fi, err = os.Lstat(filename); err != nil {
+			return
+		}
+
+		if fi.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice) != 0 {
+			continue
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(filename); err != nil {
+				return
+			}
+		}
+
+		var hdr *tar.Header
+		if hdr, err = tar.FileInfoHeader(fi, link); err != nil {
+			return
+		}
+
+		hdr.Name = path.Join(appDir, filepath.ToSlash(names[i]))
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+
+		hdr.Uid, hdr.Gid = uid, gid
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.ModTime = modTime
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return
+		}
+
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		if err = copyFileTo(tw, filename); err != nil {
+			return
+		}
+	}
+
+	return tw.Close()
+}
+
+func copyFileTo(w io.Writer, filename string) (err error) {
+	var f *os.File
+	if f, err = os.Open(filename); err != nil {
+		return
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+
+	return
+}
+
+// numericUser parses user as uid[:gid], names are owned by root
+func numericUser(user string) (uid, gid int) {
+	parts := strings.SplitN(user, ":", 2)
+
+	var err error
+	if uid, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0
+	}
+
+	gid = uid
+	if len(parts) == 2 {
+		if g, e := strconv.Atoi(parts[1]); e == nil {
+			gid = g
+		}
+	}
+
+	return
+}
@@ -0,0 +1,245 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testBaseConfig is the config of a base image with the fields which are
+// not of ImageConfig
+const testBaseConfig = `{
+	"architecture": "amd64",
+	"os": "linux",
+	"os.version": "10.0.17763.1879",
+	"config": {
+		"Env": ["PATH=/usr/local/bin:/usr/bin:/bin"],
+		"Cmd": ["/bin/sh"],
+		"Labels": {"maintainer": "gogap"},
+		"Healthcheck": {"Test": ["CMD", "true"], "Interval": 30000000000},
+		"ArgsEscaped": true,
+		"OnBuild": ["RUN echo onbuild"],
+		"Shell": ["/bin/sh", "-c"]
+	},
+	"rootfs": {"type": "layers", "diff_ids": ["sha256:base1", "sha256:base2"]},
+	"history": [{"created_by": "base"}]
+}`
+
+// pushBaseImage pushes a linux/amd64 image of testBaseConfig and two layers
+// as gogap/base:v1, and returns the host of registry and the base manifest
+func pushBaseImage(t *testing.T, registry *MemoryRegistry) (host string, manifest Manifest) {
+	client := newTestRegistry(t, registry, RegistryAuth{})
+
+	blobs := memoryBlobs{}
+	manifest = Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        blobs.add(MediaTypeOCIConfig, []byte(testBaseConfig)),
+		Layers: []Descriptor{
+			blobs.add(MediaTypeOCILayerGzip, []byte("base1")),
+			blobs.add(MediaTypeDockerLayerGzip, []byte("base2")),
+		},
+	}
+
+	if _, err := client.PushImage("gogap/base", "v1", blobs.addJSON(t, MediaTypeOCIManifest, manifest), blobs); err != nil {
+		t.Fatal(err)
+	}
+
+	return client.base.Host, manifest
+}
+
+// checkImageConfig checks the fields of base config are kept in config
+func checkImageConfig(t *testing.T, data []byte, entrypoint []string, labels map[string]string) {
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if config["os.version"] != "10.0.17763.1879" {
+		t.Errorf("os.version = %v, want the one of base image", config["os.version"])
+	}
+
+	runConfig, _ := config["config"].(map[string]interface{})
+
+	for _, field := range []string{"Healthcheck", "ArgsEscaped", "OnBuild", "Shell", "Env"} {
+		if _, exist := runConfig[field]; !exist {
+			t.Errorf("%s of base image is dropped: %s", field, data)
+		}
+	}
+
+	if _, exist := runConfig["Cmd"]; exist {
+		t.Errorf("Cmd of base image should be reset by the entrypoint: %s", data)
+	}
+
+	var got ImageConfig
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got.Config.Entrypoint, entrypoint) {
+		t.Errorf("entrypoint = %q, want %q", got.Config.Entrypoint, entrypoint)
+	}
+
+	for k, v := range labels {
+		if got.Config.Labels[k] != v {
+			t.Errorf("label %s = %q, want %q", k, got.Config.Labels[k], v)
+		}
+	}
+
+	if len(got.RootFS.DiffIDs) != 3 || got.RootFS.DiffIDs[0] != "sha256:base1" {
+		t.Errorf("diff ids = %q, want the base ones and the app one", got.RootFS.DiffIDs)
+	}
+}
+
+func TestImageConfigUnknownFields(t *testing.T) {
+	var config ImageConfig
+	if err := json.Unmarshal([]byte(testBaseConfig), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Config.Cmd = []string{"/app"}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got, want map[string]interface{}
+	json.Unmarshal(data, &got)
+	json.Unmarshal([]byte(testBaseConfig), &want)
+
+	want["config"].(map[string]interface{})["Cmd"] = []interface{}{"/app"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("config = %s, want %s", data, testBaseConfig)
+	}
+}
+
+func TestImageAssemblerAssemble(t *testing.T) {
+	registry := &MemoryRegistry{}
+	host, base := pushBaseImage(t, registry)
+
+	contextDir := t.TempDir()
+	writeFiles(t, contextDir, "server", "conf/app.conf", "Dockerfile")
+
+	layoutDir := t.TempDir()
+	layout, err := newOCILayoutWriter(layoutDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assembler := &ImageAssembler{
+		Base:       host + "/gogap/base:v1",
+		Entrypoint: []string{"/go/app/server"},
+		Labels:     map[string]string{"version": "v1"},
+		Created:    testBuildTime,
+		Exclude:    []string{"Dockerfile"},
+	}
+
+	_, manifest, err := assembler.Assemble(layout, contextDir, Platform{OS: "linux", Arch: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Layers) != 3 {
+		t.Fatalf("layers = %+v, want the base layers and the app layer", manifest.Layers)
+	}
+
+	for i := 0; i < len(base.Layers); i++ {
+		if manifest.Layers[i].Digest != base.Layers[i].Digest || manifest.Layers[i].MediaType != MediaTypeOCILayerGzip {
+			t.Errorf("layer %d = %+v, want %s of %s", i, manifest.Layers[i], base.Layers[i].Digest, MediaTypeOCILayerGzip)
+		}
+	}
+
+	config, err := ioutil.ReadFile(filepath.Join(layoutDir, blobArchivePath(manifest.Config.Digest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkImageConfig(t, config, []string{"/go/app/server"}, map[string]string{"maintainer": "gogap", "version": "v1"})
+
+	var got ImageConfig
+	json.Unmarshal(config, &got)
+
+	if got.Created != testBuildTime.Format(time.RFC3339) || got.Config.WorkingDir != nativeAppDir {
+		t.Errorf("created and working dir = %s %s, want %s %s", got.Created, got.Config.WorkingDir, testBuildTime.Format(time.RFC3339), nativeAppDir)
+	}
+}
+
+// TestBuildNativeImage builds an image of the native engine on a base image
+// of MemoryRegistry, and pushes it to the registry
+func TestBuildNativeImage(t *testing.T) {
+	isolateEnv(t)
+
+	registry := &MemoryRegistry{}
+	host, base := pushBaseImage(t, registry)
+
+	dir := t.TempDir()
+	writeFiles(t, dir, "_output_/linux_amd64/server", "_output_/linux_amd64/conf/app.conf")
+
+	builder := &Builder{
+		Runner: noGitRunner(),
+		Docker: &RecordingDocker{},
+		Options: BuildOptions{
+			WorkDir:      dir,
+			AppName:      "server",
+			AppImage:     host + "/gogap/base:v1",
+			AppImageTags: []string{"v1"},
+			RegistryHost: host,
+			RegistryOrg:  "myorg",
+			Platforms:    []string{"linux/amd64"},
+			Engine:       EngineNative,
+			BuildTime:    testBuildTime,
+		},
+	}
+
+	if err := builder.BuildImage(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := builder.PushImage(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _, exist := registry.Manifest("myorg/server", "v1")
+	if !exist {
+		t.Fatal("myorg/server:v1 is not pushed")
+	}
+
+	if digest := builder.ImageIDs[host+"/myorg/server:v1"]; digest != digestOf(data) {
+		t.Errorf("image id = %s, want %s", digest, digestOf(data))
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Layers) != 3 {
+		t.Fatalf("layers = %+v, want the base layers and the app layer", manifest.Layers)
+	}
+
+	for i := 0; i < len(manifest.Layers); i++ {
+		if i < len(base.Layers) && manifest.Layers[i].Digest != base.Layers[i].Digest {
+			t.Errorf("layer %d = %s, want %s", i, manifest.Layers[i].Digest, base.Layers[i].Digest)
+		}
+
+		if _, exist := registry.Blob("myorg/server", manifest.Layers[i].Digest); !exist {
+			t.Errorf("layer %s is not pushed", manifest.Layers[i].Digest)
+		}
+	}
+
+	config, exist := registry.Blob("myorg/server", manifest.Config.Digest)
+	if !exist {
+		t.Fatalf("config %s is not pushed", manifest.Config.Digest)
+	}
+
+	checkImageConfig(t, config, []string{"/go/app/server"}, map[string]string{"maintainer": "gogap", LabelOCITitle: "server", LabelOCIVersion: "v1"})
+
+	if manifest.Annotations[LabelOCITitle] != "server" {
+		t.Errorf("annotations = %q, want the title server", manifest.Annotations)
+	}
+}
@@ -1,16 +1,19 @@
 package builder
 
 import (
-	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
-	"text/template"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gogap/logrus_mate"
@@ -20,38 +23,81 @@ var (
 	logger = logrus_mate.Logger()
 )
 
+const (
+	// DefaultBuilderImage is the go image to build app, it supports both go
+	// modules and GOPATH projects by GO111MODULE=off
+	DefaultBuilderImage = "golang:1.21-alpine"
+
+	// defaultModCacheVolume is the docker volume used to persist the go
+	// module cache between builds when no host dir is given
+	defaultModCacheVolume = "go-to-docker-gomod"
+)
+
 type BuildOption func(*BuildOptions)
 
 type Builder struct {
 	Options BuildOptions
 
+	// Docker is the docker daemon client, default is the engine api client of $DOCKER_HOST
+	Docker DockerClient
+	// Runner runs git and local go build, default is ExecRunner
+	Runner Runner
+	// Plan makes Builder a dry run, nothing is executed but added to Plan
+	Plan *Plan
+
+	// Artifacts are the binaries produced by the last BuildApp
+	Artifacts []Artifact
+	// ImageIDs are the image ids built by BuildImage, keyed by image ref
+	ImageIDs map[string]string
+	// ImageDigests are the manifest digests pushed by PushImage, keyed by image ref
+	ImageDigests map[string]string
+
 	initOnce sync.Once
 }
 
 type BuildOptions struct {
-	Verbose            bool
-	BuilderImage       string
-	AppImage           string
-	WorkDir            string
-	AppName            string
-	DockerfileTmpl     string
-	AppImageTags       []string
-	Exposes            []string
-	BuildOutputDir     string
-	RegistryHost       string
-	RegistryOrg        string
-	RegistryUsername   string
-	RegistryPassword   string
-	AppArgs            map[string]string
-	TriggerURIs        []string
-	Resources          []string
-	BuilderImageUser   string
-	AppImageUser       string
-	RevisionBranch     string
-	RevisionID         string
-	BranchTagsConfig   BranchTagsConfig
-	DockerInDockerUser string
-	GoPath             string
+	Verbose               bool
+	BuilderImage          string
+	AppImage              string
+	WorkDir               string
+	AppName               string
+	DockerfileTmpl        string
+	AppImageTags          []string
+	Exposes               []string
+	BuildOutputDir        string
+	RegistryHost          string
+	RegistryOrg           string
+	RegistryUsername      string
+	RegistryPassword      string
+	RegistryIdentityToken string
+	AppArgs               map[string]string
+	TriggerURIs           []string
+	Resources             []string
+	BuilderImageUser      string
+	AppImageUser          string
+	RevisionBranch        string
+	RevisionID            string
+	RevisionTag           string
+	RevisionDirty         bool
+	RevisionSource        string
+	DirtyPolicy           string
+	ReleaseLatest         bool
+	BranchPattern         string
+	BranchTagsConfig      BranchTagsConfig
+	DockerInDockerUser    string
+	GoPath                string
+	ModCache              string
+	Platforms             []string
+	LDFlagsVars           map[string]string
+	Engine                string
+	ImageFormat           string
+	ArchivePath           string
+	Hermetic              bool
+	// BuildTime is the time of tags, labels and ldflags, default is BuildTime()
+	BuildTime time.Time
+	// Labels are the labels of images besides the revision and OCI labels,
+	// they override the labels of the same keys
+	Labels map[string]string
 }
 
 func Verbose(v bool) BuildOption {
@@ -107,10 +153,24 @@ func BuildOutputDir(dir string) BuildOption {
 	}
 }
 
+// imageName is the image repository of app, e.g: registry/org/app,
+// organization and app name are lowercased as docker requires
+func imageName(options BuildOptions) string {
+	return path.Join(options.RegistryHost, strings.ToLower(options.RegistryOrg), strings.ToLower(options.AppName))
+}
+
+func (p *Builder) dryRun() bool {
+	return p.Plan != nil
+}
+
 func (p *Builder) initOptions() (err error) {
 
 	p.initOnce.Do(func() {
 
+		if p.Options.BuildTime.IsZero() {
+			p.Options.BuildTime = BuildTime()
+		}
+
 		if p.Options.AppName == "" {
 			p.Options.AppName = "app"
 		}
@@ -121,8 +181,13 @@ func (p *Builder) initOptions() (err error) {
 			}
 		}
 
+		// docker bind mounts need absolute path
+		if p.Options.WorkDir, err = filepath.Abs(p.Options.WorkDir); err != nil {
+			return
+		}
+
 		if p.Options.BuilderImage == "" {
-			p.Options.BuilderImage = "golang:1.8-alpine"
+			p.Options.BuilderImage = DefaultBuilderImage
 		}
 
 		if p.Options.AppImage == "" {
@@ -133,37 +198,97 @@ func (p *Builder) initOptions() (err error) {
 			p.Options.BuildOutputDir = "_output_"
 		}
 
+		if p.Options.Engine == "" {
+			p.Options.Engine = EngineDocker
+		}
+
+		if p.Options.ImageFormat == "" {
+			p.Options.ImageFormat = ImageFormatOCI
+		}
+
+		if err = validateEngine(p.Options.Engine, p.Options.ImageFormat); err != nil {
+			return
+		}
+
+		if p.Options.Hermetic && p.Options.Engine != EngineDocker {
+			err = fmt.Errorf("hermetic build is a multi-stage docker build, it could not use %s engine", p.Options.Engine)
+			return
+		}
+
 		if p.Options.Verbose {
 			logger.Level = logrus.DebugLevel
 		} else {
 			logger.Level = logrus.WarnLevel
 		}
 
+		if p.Runner == nil {
+			p.Runner = ExecRunner{}
+		}
+
+		if p.dryRun() {
+			p.Runner = &dryRunRunner{runner: p.Runner, plan: p.Plan}
+			p.Docker = &dryRunDocker{plan: p.Plan}
+		}
+
+		if p.Docker == nil {
+			if p.Docker, err = NewEngineClient(""); err != nil {
+				return
+			}
+		}
+
 		if p.Options.DockerfileTmpl == "" {
-			p.Options.DockerfileTmpl = filepath.Join(os.Getenv("GOPATH"), "src", "github.com/gogap/go-to-docker/builder/dockerfiles_templ/default")
+			p.Options.DockerfileTmpl = DefaultTemplate
 		}
 
-		var isGit bool
-		var revisionBranch, revisionID string
+		var knownRevision bool
+		var revision Revision
 
-		if revisionBranch, revisionID, isGit, err = getRevision(p.Options.WorkDir); err != nil {
+		if revision, knownRevision, err = getRevision(p.Runner, p.Options.WorkDir, os.Getenv); err != nil {
 			return
-		} else if isGit {
+		} else if knownRevision {
+
+			// a faked branch is not a release even if HEAD is tagged
+			isRelease := len(revision.Tag) > 0 && len(p.Options.RevisionBranch) == 0
 
 			if len(p.Options.RevisionBranch) == 0 {
-				p.Options.RevisionBranch = revisionBranch
+				p.Options.RevisionBranch = revision.Branch
+
+				// detached HEAD of a release is named by its tag, so
+				// branch configs like v* could match it
+				if isRelease && revision.Branch == "HEAD" {
+					p.Options.RevisionBranch = revision.Tag
+				}
 			}
 
-			p.Options.RevisionID = revisionID
+			p.Options.RevisionID = revision.ShortSHA()
+			p.Options.RevisionSource = revision.Source
+
+			p.Options.RevisionDirty = revision.Dirty
+			if revision.Dirty {
+				logger.Warnf("working tree of %s has uncommitted changes", p.Options.WorkDir)
+			}
+
+			if isRelease {
+				p.Options.RevisionTag = revision.Tag
+				logger.Debugf("HEAD is at release tag %s", revision.Tag)
+			}
 
 			branchHasTags := false
 			if p.Options.BranchTagsConfig.Branchs != nil {
-				if branchTag, exist := p.Options.BranchTagsConfig.Branchs[p.Options.RevisionBranch]; exist {
+				var branchTag BranchTag
+				var exist bool
+				if branchTag, p.Options.BranchPattern, exist, err = p.Options.BranchTagsConfig.Match(p.Options.RevisionBranch); err != nil {
+					return
+				} else if exist {
+					logger.Debugf("branch %s matched branch config %q", p.Options.RevisionBranch, p.Options.BranchPattern)
 
 					p.Options.RegistryUsername = branchTag.Username
 					p.Options.RegistryPassword = branchTag.Password
 					p.Options.RegistryHost = branchTag.Server
 					p.Options.RegistryOrg = branchTag.Organization
+					if len(branchTag.Dirty) > 0 {
+						p.Options.DirtyPolicy = branchTag.Dirty
+					}
 					if len(branchTag.Tags) > 0 {
 						branchHasTags = true
 						p.Options.AppImageTags = append(p.Options.AppImageTags, branchTag.Tags...)
@@ -171,24 +296,67 @@ func (p *Builder) initOptions() (err error) {
 				}
 			}
 
-			if !branchHasTags {
-				p.Options.AppImageTags = append(p.Options.AppImageTags, p.Options.RevisionBranch, p.Options.RevisionBranch+"-"+p.Options.RevisionID)
+			if !branchHasTags && isRelease {
+				var allTags []string
+				if p.Options.ReleaseLatest {
+					if allTags, err = listGitTags(p.Runner, p.Options.WorkDir); err != nil {
+						return
+					}
+				}
+
+				var tags []string
+				if tags, err = releaseTags(revision.Tag, allTags, p.Options.ReleaseLatest); err != nil {
+					return
+				}
+
+				p.Options.AppImageTags = append(p.Options.AppImageTags, tags...)
+			} else if !branchHasTags {
+				p.Options.AppImageTags = append(p.Options.AppImageTags, DefaultTagTemplates...)
 			}
 		} else if len(p.Options.AppImageTags) == 0 {
 			p.Options.AppImageTags = []string{"latest"}
 		}
+
+		tagContext := newTagContext(p.Options.RevisionBranch, revision, p.Options.BuildTime)
+		if p.Options.AppImageTags, err = renderTags(p.Options.AppImageTags, tagContext); err != nil {
+			return
+		}
+
+		if err = validateDirtyPolicy(p.Options.DirtyPolicy); err != nil {
+			return
+		}
+
+		// a dirty build must not overwrite the image of the committed revision
+		if p.Options.RevisionDirty && p.Options.DirtyPolicy != DirtyRefuse {
+			for i := 0; i < len(p.Options.AppImageTags); i++ {
+				p.Options.AppImageTags[i] = dirtyTag(p.Options.AppImageTags[i])
+			}
+		}
+
+		if p.dryRun() {
+			p.Plan.resolve(p.Options)
+		}
 	})
 
 	return
 }
 
-// docker run --rm -v "$PWD":/usr/src/myapp -w /usr/src/myapp golang:1.6 go build -v
 func (p *Builder) BuildApp() (err error) {
 
 	if err = p.initOptions(); err != nil {
 		return
 	}
 
+	// the tags are checked before compiling, not after it in build image
+	if err = p.validateImageRefs(); err != nil {
+		return
+	}
+
+	var platforms []Platform
+	if platforms, err = ParsePlatforms(p.Options.Platforms...); err != nil {
+		return
+	}
+
 	cwd, _ := os.Getwd()
 	if cwd != p.Options.WorkDir {
 		os.Chdir(p.Options.WorkDir)
@@ -200,56 +368,79 @@ func (p *Builder) BuildApp() (err error) {
 		}
 	}()
 
-	buildpath := filepath.Join(p.Options.BuildOutputDir, p.Options.AppName)
+	var resPaths []string
+	if resPaths, err = p.resourcePaths(); err != nil {
+		return
+	}
 
-	buildCMD := ""
-	if p.Options.BuilderImage == "local" {
-		logger.Debugln("use local go build")
-		buildCMD = fmt.Sprintf("go build -o %s", buildpath)
-	} else {
-		if len(p.Options.BuilderImageUser) == 0 {
-			buildCMD = fmt.Sprintf(`docker run --rm -v %s:/usr/src/myapp -v %s:/go -w /usr/src/myapp %s go build -o %s`, p.Options.WorkDir, p.Options.GoPath, p.Options.BuilderImage, buildpath)
-		} else {
-			buildCMD = fmt.Sprintf(`docker run --rm -u %s -v %s:/usr/src/myapp -v %s:/go -w /usr/src/myapp %s go build -o %s`, p.Options.BuilderImageUser, p.Options.WorkDir, p.Options.GoPath, p.Options.BuilderImage, buildpath)
+	ldflags := p.ldflags(p.Options.BuildTime)
+
+	p.Artifacts = nil
+
+	if len(platforms) == 0 {
+		if err = p.buildAppTo(p.Options.BuildOutputDir, nil, ldflags, resPaths); err != nil {
+			return
 		}
 	}
 
-	if p.Options.Verbose {
-		buildCMD += " -v"
+	for i := 0; i < len(platforms); i++ {
+		outputDir := filepath.Join(p.Options.BuildOutputDir, platforms[i].Dir())
+		if err = p.buildAppTo(outputDir, &platforms[i], ldflags, resPaths); err != nil {
+			return
+		}
 	}
 
-	logger.Debugln(buildCMD)
+	if p.dryRun() {
+		return
+	}
 
-	if err = execCommandToShow(p.Options.WorkDir, buildCMD); err != nil {
+	// the artifacts of a single platform build replace the platforms of a
+	// former multi platform build, which BuildImage would take
+	if err = writeArtifacts(p.Options.BuildOutputDir, p.Artifacts); err != nil {
 		return
 	}
 
-	var resPaths []string
+	return
+}
 
-	if len(p.Options.Resources) > 0 {
-		for i := 0; i < len(p.Options.Resources); i++ {
-			var paths []string
-			if paths, err = filepath.Glob(p.Options.Resources[i]); err != nil {
-				return
-			}
+// buildAppTo compiles the app into outputDir, cross compiling when platform
+// is not nil, and copies the app resources beside the binary
+func (p *Builder) buildAppTo(outputDir string, platform *Platform, ldflags string, resPaths []string) (err error) {
 
-			var washedPaths []string
-			for j := 0; j < len(paths); j++ {
-				washedpath := paths[j]
-				if filepath.IsAbs(paths[j]) {
-					if washedpath, err = filepath.Rel(p.Options.WorkDir, paths[j]); err != nil {
-						return
-					}
-				}
-				washedPaths = append(washedPaths, washedpath)
-			}
-			resPaths = append(resPaths, washedPaths...)
+	buildpath := filepath.Join(outputDir, p.Options.AppName)
+
+	if p.Options.BuilderImage == "local" {
+		logger.Debugln("use local go build")
+
+		buildArgs := p.localGoBuildArgs(buildpath, platform, ldflags)
+
+		logger.Debugln(shellJoin(buildArgs))
+
+		if err = p.Runner.Run(p.Options.WorkDir, buildArgs...); err != nil {
+			return
+		}
+	} else {
+		var config ContainerConfig
+		if config, err = p.goBuildContainer(buildpath, platform, ldflags); err != nil {
+			return
+		}
+
+		logger.Debugln(shellJoin(config.Args()))
+
+		if err = p.Docker.RunContainer(config); err != nil {
+			return
 		}
 	}
 
 	for i := 0; i < len(resPaths); i++ {
 
-		confPath := filepath.Join(p.Options.BuildOutputDir, resPaths[i])
+		confPath := filepath.Join(outputDir, resPaths[i])
+
+		if p.dryRun() {
+			p.Plan.addCommand("cp", resPaths[i], confPath)
+			continue
+		}
+
 		confDir, _ := filepath.Split(confPath)
 		if err = os.MkdirAll(confDir, 0755); err != nil {
 			return
@@ -261,6 +452,153 @@ func (p *Builder) BuildApp() (err error) {
 		}
 	}
 
+	artifact := Artifact{Path: buildpath}
+	if platform != nil {
+		artifact.Platform = platform.String()
+	}
+
+	p.Artifacts = append(p.Artifacts, artifact)
+
+	return
+}
+
+// moduleRoot returns the go module root of workdir and whether the module
+// has a vendor dir
+func (p *Builder) moduleRoot() (modRoot string, isModule, useVendor bool) {
+
+	if modRoot, isModule = findModuleRoot(p.Options.WorkDir); !isModule {
+		return
+	}
+
+	if fi, e := os.Stat(filepath.Join(modRoot, "vendor")); e == nil && fi.IsDir() {
+		useVendor = true
+	}
+
+	logger.Debugf("go module root: %s, vendor: %v", modRoot, useVendor)
+
+	return
+}
+
+func (p *Builder) goBuildCommand(buildpath, ldflags string, modVendor bool) []string {
+	goArgs := []string{"go", "build"}
+
+	if modVendor {
+		goArgs = append(goArgs, "-mod=vendor")
+	}
+
+	if len(ldflags) > 0 {
+		goArgs = append(goArgs, "-ldflags", ldflags)
+	}
+
+	goArgs = append(goArgs, "-o", buildpath)
+
+	if p.Options.Verbose {
+		goArgs = append(goArgs, "-v")
+	}
+
+	return goArgs
+}
+
+func (p *Builder) localGoBuildArgs(buildpath string, platform *Platform, ldflags string) (buildArgs []string) {
+
+	_, _, useVendor := p.moduleRoot()
+
+	if platform != nil {
+		buildArgs = append(buildArgs, "env")
+		buildArgs = append(buildArgs, platform.GoEnvs()...)
+	}
+
+	buildArgs = append(buildArgs, p.goBuildCommand(buildpath, ldflags, useVendor)...)
+
+	return
+}
+
+// docker run --rm -v "$PWD":/usr/src/myapp -w /usr/src/myapp golang:1.6 go build -v
+func (p *Builder) goBuildContainer(buildpath string, platform *Platform, ldflags string) (config ContainerConfig, err error) {
+
+	modRoot, isModule, useVendor := p.moduleRoot()
+
+	config = ContainerConfig{
+		Image:  p.Options.BuilderImage,
+		User:   p.Options.BuilderImageUser,
+		Cmd:    p.goBuildCommand(buildpath, ldflags, false),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	if isModule {
+		// mount the whole module so that replace directives and
+		// sibling packages are visible, then build from the workdir
+		var relDir string
+		if relDir, err = filepath.Rel(modRoot, p.Options.WorkDir); err != nil {
+			return
+		}
+
+		config.Mounts = []Mount{BindMount(modRoot, "/usr/src/myapp"), p.modCacheMount()}
+		config.Env = []string{"GO111MODULE=on"}
+
+		if useVendor {
+			config.Env = append(config.Env, "GOFLAGS=-mod=vendor")
+		}
+
+		config.WorkingDir = path.Join("/usr/src/myapp", filepath.ToSlash(relDir))
+	} else {
+		config.Mounts = []Mount{BindMount(p.Options.WorkDir, "/usr/src/myapp")}
+
+		if len(p.Options.GoPath) > 0 {
+			config.Mounts = append(config.Mounts, BindMount(p.Options.GoPath, "/go"))
+		}
+
+		config.Env = []string{"GO111MODULE=off"}
+		config.WorkingDir = "/usr/src/myapp"
+	}
+
+	if platform != nil {
+		config.Env = append(config.Env, platform.GoEnvs()...)
+	}
+
+	return
+}
+
+// modCacheMount mounts the go module cache, ModCache is a host dir if it
+// looks like a path, otherwise a docker volume name
+func (p *Builder) modCacheMount() Mount {
+	modCache := p.Options.ModCache
+	if len(modCache) == 0 {
+		return VolumeMount(defaultModCacheVolume, "/go/pkg/mod")
+	}
+
+	if filepath.IsAbs(modCache) || strings.HasPrefix(modCache, ".") || strings.ContainsRune(modCache, filepath.Separator) {
+		if !filepath.IsAbs(modCache) {
+			modCache = filepath.Join(p.Options.WorkDir, modCache)
+		}
+		return BindMount(modCache, "/go/pkg/mod")
+	}
+
+	return VolumeMount(modCache, "/go/pkg/mod")
+}
+
+func (p *Builder) resourcePaths() (resPaths []string, err error) {
+
+	for i := 0; i < len(p.Options.Resources); i++ {
+		var paths []string
+		if paths, err = filepath.Glob(p.Options.Resources[i]); err != nil {
+			return
+		}
+
+		var washedPaths []string
+		for j := 0; j < len(paths); j++ {
+			washedpath := paths[j]
+			if filepath.IsAbs(paths[j]) {
+				if washedpath, err = filepath.Rel(p.Options.WorkDir, paths[j]); err != nil {
+					return
+				}
+			}
+			washedPaths = append(washedPaths, washedpath)
+		}
+		resPaths = append(resPaths, washedPaths...)
+	}
+
 	return
 }
 
@@ -278,6 +616,16 @@ func (p *Builder) BuildImage() (err error) {
 		return
 	}
 
+	if err = p.validateImageRefs(); err != nil {
+		return
+	}
+
+	for i := 0; i < len(p.Options.Exposes); i++ {
+		if err = ValidateExpose(p.Options.Exposes[i]); err != nil {
+			return
+		}
+	}
+
 	cwd, _ := os.Getwd()
 	if cwd != p.Options.WorkDir {
 		os.Chdir(p.Options.WorkDir)
@@ -289,75 +637,205 @@ func (p *Builder) BuildImage() (err error) {
 		}
 	}()
 
-	var fi os.FileInfo
-	if fi, err = os.Stat(p.Options.BuildOutputDir); err != nil {
-		return
+	// hermetic builds compile the app from source, no build output is needed
+	if !p.dryRun() && !p.Options.Hermetic {
+		var fi os.FileInfo
+		if fi, err = os.Stat(p.Options.BuildOutputDir); err != nil {
+			return
+		}
+
+		if !fi.IsDir() {
+			err = errors.New("output path should be a dir, not a file")
+			return
+		}
 	}
 
-	if !fi.IsDir() {
-		err = errors.New("output path should be a dir, not a file")
+	var platforms []Platform
+	if platforms, err = p.targetPlatforms(); err != nil {
 		return
 	}
 
-	binpath := filepath.Join(p.Options.BuildOutputDir, p.Options.AppName)
-	if fi, err = os.Stat(binpath); err != nil {
-		if os.IsNotExist(err) {
-			err = errors.New("please build app first")
-			return
-		}
-		return
+	if p.Options.Engine == EngineNative {
+		return p.buildNativeImage(platforms)
 	}
 
-	if fi.IsDir() {
-		err = errors.New(binpath + " should be an executable file")
+	var dockerfileContent []byte
+	if dockerfileContent, err = p.renderDockerfile(); err != nil {
 		return
 	}
 
-	logger.Debugf("using Dockerfile template of %s", p.Options.DockerfileTmpl)
+	if p.Options.Hermetic {
+		return p.buildHermeticImage(platforms, dockerfileContent)
+	}
 
-	var tmplbuf []byte
-	if tmplbuf, err = ioutil.ReadFile(p.Options.DockerfileTmpl); err != nil {
-		return
+	if p.dryRun() {
+		p.Plan.setDockerfile(nil, dockerfileContent)
+	} else {
+		os.RemoveAll(filepath.Join(p.Options.BuildOutputDir, ".docker"))
 	}
 
-	var tmpl *template.Template
-	if tmpl, err = template.New(p.Options.AppImage).Parse(string(tmplbuf)); err != nil {
+	if len(platforms) == 0 {
+		if err = p.buildImageIn(p.Options.BuildOutputDir, nil, dockerfileContent); err != nil {
+			return
+		}
+
 		return
 	}
 
-	buf := bytes.NewBuffer(nil)
-	if err = tmpl.Execute(buf, p.Options); err != nil {
-		return
+	for i := 0; i < len(platforms); i++ {
+		contextDir := filepath.Join(p.Options.BuildOutputDir, platforms[i].Dir())
+		if err = p.buildImageIn(contextDir, &platforms[i], dockerfileContent); err != nil {
+			return
+		}
 	}
 
-	dockerfileContent := buf.Bytes()
+	return
+}
+
+// buildImageIn runs docker build with contextDir as build context, the image
+// of a platform is tagged with the platform suffix, the manifest list of all
+// platforms is created while pushing
+func (p *Builder) buildImageIn(contextDir string, platform *Platform, dockerfileContent []byte) (err error) {
+
+	binpath := filepath.Join(contextDir, p.Options.AppName)
+
+	if !p.dryRun() {
+		var fi os.FileInfo
+		if fi, err = os.Stat(binpath); err != nil {
+			if os.IsNotExist(err) {
+				err = errors.New("please build app first")
+				return
+			}
+			return
+		}
+
+		if fi.IsDir() {
+			err = errors.New(binpath + " should be an executable file")
+			return
+		}
+	}
 
 	// docker build -t xxxx .
-	baseTagName := filepath.Join(p.Options.RegistryHost, p.Options.RegistryOrg, p.Options.AppName)
+	baseTagName := imageName(p.Options)
 
-	var tags = ""
+	options := ImageBuildOptions{
+		Dockerfile: "Dockerfile",
+		Labels:     p.imageLabels(),
+	}
 	for i := 0; i < len(p.Options.AppImageTags); i++ {
-		tags = tags + fmt.Sprintf(" -t %s:%s", baseTagName, p.Options.AppImageTags[i])
+		options.Tags = append(options.Tags, fmt.Sprintf("%s:%s", baseTagName, platformTag(p.Options.AppImageTags[i], platform)))
 	}
 
-	tags = strings.TrimSpace(tags)
+	if platform != nil {
+		options.Platform = platform.String()
+	}
 
-	dockerfilePath := filepath.Join(p.Options.BuildOutputDir, "Dockerfile")
-	if err = ioutil.WriteFile(dockerfilePath, dockerfileContent, 0644); err != nil {
+	if !p.dryRun() {
+		dockerfilePath := filepath.Join(contextDir, "Dockerfile")
+		if err = ioutil.WriteFile(dockerfilePath, dockerfileContent, 0644); err != nil {
+			return
+		}
+	}
+
+	logger.Debugf("docker build %s in %s, platform: %s", strings.Join(options.Tags, ", "), contextDir, options.Platform)
+
+	var imageID string
+	if imageID, err = p.Docker.BuildImage(contextDir, options); err != nil {
 		return
 	}
 
-	os.RemoveAll(filepath.Join(p.Options.BuildOutputDir, ".docker"))
+	logger.Debugf("image built: %s", imageID)
 
-	buildCMD := fmt.Sprintf("docker build %s .", tags)
+	if p.ImageIDs == nil {
+		p.ImageIDs = map[string]string{}
+	}
+
+	for i := 0; i < len(options.Tags); i++ {
+		p.ImageIDs[options.Tags[i]] = imageID
+	}
 
-	logger.Debugln(buildCMD)
+	return
+}
+
+// imageLabels returns the OCI labels of the app and the revision the image
+// is built from, and the labels of options
+func (p *Builder) imageLabels() map[string]string {
+	labels := p.imageAnnotations()
+
+	if len(p.Options.RevisionID) > 0 {
+		labels[LabelRevision] = p.Options.RevisionID
+		labels[LabelBranch] = p.Options.RevisionBranch
+		labels[LabelDirty] = strconv.FormatBool(p.Options.RevisionDirty)
+	}
 
-	if err = execCommandToShow(p.Options.BuildOutputDir, buildCMD); err != nil {
+	for k, v := range p.Options.Labels {
+		labels[k] = v
+	}
+
+	return labels
+}
+
+// imageAnnotations returns the pre-defined OCI labels of the image, the
+// version is the first image tag
+func (p *Builder) imageAnnotations() map[string]string {
+	annotations := map[string]string{
+		LabelOCITitle:   p.Options.AppName,
+		LabelOCICreated: p.Options.BuildTime.UTC().Format(time.RFC3339),
+	}
+
+	if len(p.Options.AppImageTags) > 0 {
+		annotations[LabelOCIVersion] = p.Options.AppImageTags[0]
+	}
+
+	if len(p.Options.RevisionID) > 0 {
+		annotations[LabelOCIRevision] = p.Options.RevisionID
+	}
+
+	if len(p.Options.RevisionSource) > 0 {
+		annotations[LabelOCISource] = p.Options.RevisionSource
+	}
+
+	// --label overrides them, e.g: a title other than the app name
+	for k := range annotations {
+		if v, exist := p.Options.Labels[k]; exist {
+			annotations[k] = v
+		}
+	}
+
+	return annotations
+}
+
+// outputDir returns the absolute path of build output dir
+func (p *Builder) outputDir() string {
+	if filepath.IsAbs(p.Options.BuildOutputDir) {
+		return p.Options.BuildOutputDir
+	}
+	return filepath.Join(p.Options.WorkDir, p.Options.BuildOutputDir)
+}
+
+// targetPlatforms returns the platforms from options, or the platforms
+// recorded by the last multi platform BuildApp
+func (p *Builder) targetPlatforms() (platforms []Platform, err error) {
+	if len(p.Options.Platforms) > 0 {
+		return ParsePlatforms(p.Options.Platforms...)
+	}
+
+	var artifacts []Artifact
+	if artifacts, err = readArtifacts(p.outputDir()); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
 		return
 	}
 
-	return
+	var values []string
+	for i := 0; i < len(artifacts); i++ {
+		if len(artifacts[i].Platform) > 0 {
+			values = append(values, artifacts[i].Platform)
+		}
+	}
+
+	return ParsePlatforms(values...)
 }
 
 // docker push [OPTIONS] NAME[:TAG]
@@ -371,51 +849,204 @@ func (p *Builder) PushImage() (err error) {
 		return
 	}
 
-	var tmpDockerconf string
-	if tmpDockerconf, err = filepath.Abs(filepath.Join(p.Options.BuildOutputDir, ".docker")); err != nil {
+	if err = p.validateImageRefs(); err != nil {
 		return
 	}
 
-	dockerInDockerFMT := "docker run --privileged --rm -v /var/run/docker.sock:/var/run/docker.sock -v " + tmpDockerconf + ":/root/.docker docker:dind %s"
+	if p.Options.RevisionDirty && p.Options.DirtyPolicy == DirtyRefuse {
+		err = fmt.Errorf("refuse to push images of branch %s, the working tree has uncommitted changes", p.Options.RevisionBranch)
+		return
+	}
 
-	if len(p.Options.RegistryUsername) > 0 {
-		cmdLogin := fmt.Sprintf(dockerInDockerFMT, fmt.Sprintf("docker login -u %s -p %s %s", p.Options.RegistryUsername, p.Options.RegistryPassword, p.Options.RegistryHost))
+	if err = p.resolveRegistryAuth(os.Getenv); err != nil {
+		return
+	}
 
-		if err = execCommandToShow("", cmdLogin); err != nil {
+	var platforms []Platform
+	if platforms, err = p.targetPlatforms(); err != nil {
+		return
+	}
+
+	auth := RegistryAuth{
+		Username:      p.Options.RegistryUsername,
+		Password:      p.Options.RegistryPassword,
+		ServerAddress: p.Options.RegistryHost,
+		IdentityToken: p.Options.RegistryIdentityToken,
+	}
+
+	if p.Options.Engine == EngineNative {
+		return p.pushNativeImage(auth)
+	}
+
+	// the engine api could not create manifest lists, the docker cli in a
+	// docker:dind container does it for multi platform images
+	var tmpDockerconf string
+	if len(platforms) > 0 {
+		tmpDockerconf = filepath.Join(p.outputDir(), ".docker")
+
+		if err = p.writeDockerInDockerAuth(tmpDockerconf); err != nil {
 			return
 		}
 
-		if len(p.Options.DockerInDockerUser) > 0 {
-			// change own
-			dockerInDockerFMT = "docker run --privileged --rm -v /var/run/docker.sock:/var/run/docker.sock -v " + tmpDockerconf + ":/root/.docker docker:dind %s"
-			cmdChown := fmt.Sprintf(dockerInDockerFMT, fmt.Sprintf("chown -R %s /root/.docker", p.Options.DockerInDockerUser))
+		defer p.cleanDockerInDocker(tmpDockerconf)
+	}
+
+	baseTagName := imageName(p.Options)
 
-			if err = execCommandToShow("", cmdChown); err != nil {
+	for i := 0; i < len(p.Options.AppImageTags); i++ {
+
+		if len(platforms) == 0 {
+			if err = p.pushImageRef(fmt.Sprintf("%s:%s", baseTagName, p.Options.AppImageTags[i]), auth); err != nil {
 				return
 			}
 
-			defer func() {
-				if e := os.RemoveAll(tmpDockerconf); e != nil {
-					logger.Warnln(e)
-				}
-			}()
+			continue
+		}
+
+		listName := fmt.Sprintf("%s:%s", baseTagName, p.Options.AppImageTags[i])
+
+		var platformImages []string
+		for j := 0; j < len(platforms); j++ {
+			image := fmt.Sprintf("%s:%s", baseTagName, platformTag(p.Options.AppImageTags[i], &platforms[j]))
+
+			if err = p.pushImageRef(image, auth); err != nil {
+				return
+			}
+
+			platformImages = append(platformImages, image)
+		}
+
+		// docker manifest create LIST IMAGE... && docker manifest push LIST
+		manifestCMDs := [][]string{
+			append([]string{"docker", "manifest", "create", "--amend", listName}, platformImages...),
 		}
 
+		for j := 0; j < len(platforms); j++ {
+			annotateCMD := []string{"docker", "manifest", "annotate", "--os", platforms[j].OS, "--arch", platforms[j].Arch}
+			if len(platforms[j].Variant) > 0 {
+				annotateCMD = append(annotateCMD, "--variant", platforms[j].Variant)
+			}
+			manifestCMDs = append(manifestCMDs, append(annotateCMD, listName, platformImages[j]))
+		}
+
+		manifestCMDs = append(manifestCMDs, []string{"docker", "manifest", "push", "--purge", listName})
+
+		for j := 0; j < len(manifestCMDs); j++ {
+			if err = p.runDockerInDocker(tmpDockerconf, manifestCMDs[j]...); err != nil {
+				return
+			}
+		}
 	}
 
-	baseTagName := filepath.Join(p.Options.RegistryHost, p.Options.RegistryOrg, p.Options.AppName)
+	return
+}
 
-	for i := 0; i < len(p.Options.AppImageTags); i++ {
-		pushCMD := fmt.Sprintf(dockerInDockerFMT, fmt.Sprintf("docker push %s:%s", baseTagName, p.Options.AppImageTags[i]))
-		logger.Debugln(pushCMD)
+// docker push [OPTIONS] NAME[:TAG]
+func (p *Builder) pushImageRef(ref string, auth RegistryAuth) (err error) {
+	logger.Debugf("docker push %s", ref)
+
+	var digest string
+	if digest, err = p.Docker.PushImage(ref, auth); err != nil {
+		return
+	}
+
+	logger.Debugf("image pushed: %s@%s", ref, digest)
+
+	if p.ImageDigests == nil {
+		p.ImageDigests = map[string]string{}
+	}
+
+	p.ImageDigests[ref] = digest
+
+	return
+}
+
+// writeDockerInDockerAuth writes the registry auth into config.json of the
+// docker config dir mounted into docker:dind, instead of docker login, so
+// the password is never on a command line
+func (p *Builder) writeDockerInDockerAuth(tmpDockerconf string) (err error) {
+	if len(p.Options.RegistryUsername) == 0 && len(p.Options.RegistryIdentityToken) == 0 {
+		return
+	}
+
+	server := p.Options.RegistryHost
+	if len(server) == 0 {
+		server = dockerHubServer
+	}
+
+	logger.Debugf("write auth of %s to %s", server, filepath.Join(tmpDockerconf, "config.json"))
+
+	if p.dryRun() {
+		return
+	}
+
+	auth := DockerConfigAuth{IdentityToken: p.Options.RegistryIdentityToken}
+	if len(p.Options.RegistryUsername) > 0 {
+		auth.Auth = base64.StdEncoding.EncodeToString([]byte(p.Options.RegistryUsername + ":" + p.Options.RegistryPassword))
+	}
+
+	config := DockerConfigFile{
+		Auths: map[string]DockerConfigAuth{server: auth},
+	}
+
+	var data []byte
+	if data, err = json.MarshalIndent(config, "", "\t"); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(tmpDockerconf, 0700); err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tmpDockerconf, "config.json"), data, 0600)
+
+	return
+}
 
-		if err = execCommandToShow("", pushCMD); err != nil {
+// cleanDockerInDocker removes the docker config dir of docker:dind, files
+// created by docker:dind are owned by root, they are chowned to
+// DockerInDockerUser first
+func (p *Builder) cleanDockerInDocker(tmpDockerconf string) {
+	if len(p.Options.DockerInDockerUser) == 0 {
+		if p.dryRun() {
 			return
 		}
 
+		// the auth is written by us, it could be removed at least
+		if e := os.Remove(filepath.Join(tmpDockerconf, "config.json")); e != nil && !os.IsNotExist(e) {
+			logger.Warnln(e)
+		}
+		return
 	}
 
-	return
+	// change own
+	if e := p.runDockerInDocker(tmpDockerconf, "chown", "-R", p.Options.DockerInDockerUser, "/root/.docker"); e != nil {
+		logger.Warnln(e)
+	}
+
+	if p.dryRun() {
+		return
+	}
+
+	if e := os.RemoveAll(tmpDockerconf); e != nil {
+		logger.Warnln(e)
+	}
+}
+
+func (p *Builder) runDockerInDocker(tmpDockerconf string, cmd ...string) (err error) {
+	config := ContainerConfig{
+		Image:      "docker:dind",
+		Cmd:        cmd,
+		Env:        []string{"DOCKER_CLI_EXPERIMENTAL=enabled"},
+		Mounts:     []Mount{BindMount("/var/run/docker.sock", "/var/run/docker.sock"), BindMount(tmpDockerconf, "/root/.docker")},
+		Privileged: true,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+	}
+
+	logger.Debugln(shellJoin(config.Args()))
+
+	return p.Docker.RunContainer(config)
 }
 
 func (p *Builder) PushTrigger() (err error) {
@@ -435,6 +1066,13 @@ func (p *Builder) PushTrigger() (err error) {
 		}
 	}
 
+	if p.dryRun() {
+		for i := 0; i < len(httpTriggers); i++ {
+			p.Plan.addCommand("curl", "-fsS", httpTriggers[i])
+		}
+		return
+	}
+
 	if err = pushHttpTriggers(httpTriggers); err != nil {
 		return
 	}
@@ -458,11 +1096,11 @@ func pushHttpTriggers(uris []string) (err error) {
 		resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			err = fmt.Errorf("uri: %s\nstatus code: %d, body: \n%s\n", uris[i], resp.StatusCode, string(body))
+			err = fmt.Errorf("uri: %s\nstatus code: %d, body: \n%s\n", redactURL(uris[i]), resp.StatusCode, string(body))
 			return
 		}
 
-		logger.Infof("trigger: %s", uris[i])
+		logger.Infof("trigger: %s", redactURL(uris[i]))
 		logger.Debugf("body:\n%s", string(body))
 	}
 
@@ -498,6 +1136,11 @@ func (p *Builder) ClearApp() (err error) {
 		return
 	}
 
+	if p.dryRun() {
+		p.Plan.addCommand("rm", "-rf", p.outputDir())
+		return
+	}
+
 	if err = os.RemoveAll(p.Options.BuildOutputDir); err != nil {
 		return
 	}
@@ -516,21 +1159,41 @@ func (p *Builder) ClearImage() (err error) {
 		return
 	}
 
-	baseTagName := filepath.Join(p.Options.RegistryHost, p.Options.RegistryOrg, p.Options.AppName)
+	if err = p.validateImageRefs(); err != nil {
+		return
+	}
+
+	if p.Options.Engine == EngineNative {
+		return p.clearNativeImage()
+	}
+
+	var platforms []Platform
+	if platforms, err = p.targetPlatforms(); err != nil {
+		return
+	}
+
+	baseTagName := imageName(p.Options)
 
 	var images []string
 	for i := 0; i < len(p.Options.AppImageTags); i++ {
-		image := fmt.Sprintf("%s:%s", baseTagName, p.Options.AppImageTags[i])
-		images = append(images, image)
+		if len(platforms) == 0 {
+			image := fmt.Sprintf("%s:%s", baseTagName, p.Options.AppImageTags[i])
+			images = append(images, image)
+			continue
+		}
+
+		for j := 0; j < len(platforms); j++ {
+			image := fmt.Sprintf("%s:%s", baseTagName, platformTag(p.Options.AppImageTags[i], &platforms[j]))
+			images = append(images, image)
+		}
 	}
 
-	rmiCMD := "docker rmi " + strings.Join(images, " ")
-	logger.Debugln(rmiCMD)
+	for i := 0; i < len(images); i++ {
+		logger.Debugf("docker rmi %s", images[i])
 
-	var out []byte
-	if out, err = execCommand("", rmiCMD); err != nil {
-		err = errors.New(string(out))
-		return
+		if err = p.Docker.RemoveImage(images[i], false); err != nil {
+			return
+		}
 	}
 
 	return
@@ -0,0 +1,150 @@
+package builder
+
+import (
+	"strings"
+)
+
+// CIRevision is the revision of a CI build read from its env vars
+type CIRevision struct {
+	Branch      string
+	Tag         string
+	SHA         string
+	BuildNumber string
+}
+
+// RevisionProvider reads the revision from env of a CI system, ok is false
+// if the build is not running in it
+type RevisionProvider struct {
+	Name     string
+	Revision func(getenv func(string) string) (revision CIRevision, ok bool)
+}
+
+// RevisionProviders are checked in order before falling back to git
+var RevisionProviders = []RevisionProvider{
+	{Name: "GTD_* env", Revision: gtdRevision},
+	{Name: "GitHub Actions", Revision: githubRevision},
+	{Name: "GitLab CI", Revision: gitlabRevision},
+	{Name: "Jenkins", Revision: jenkinsRevision},
+	{Name: "Drone", Revision: droneRevision},
+}
+
+// detectCIRevision returns the revision of the first provider detected
+func detectCIRevision(getenv func(string) string) (revision CIRevision, source string, ok bool) {
+	for i := 0; i < len(RevisionProviders); i++ {
+		if revision, ok = RevisionProviders[i].Revision(getenv); ok {
+			source = RevisionProviders[i].Name
+			return
+		}
+	}
+
+	return
+}
+
+// gtdRevision reads GTD_BRANCH, GTD_TAG, GTD_COMMIT and GTD_BUILD_NUMBER
+func gtdRevision(getenv func(string) string) (revision CIRevision, ok bool) {
+	revision = CIRevision{
+		Branch:      getenv("GTD_BRANCH"),
+		Tag:         getenv("GTD_TAG"),
+		SHA:         getenv("GTD_COMMIT"),
+		BuildNumber: getenv("GTD_BUILD_NUMBER"),
+	}
+
+	ok = len(revision.Branch) > 0 || len(revision.Tag) > 0 || len(revision.SHA) > 0
+
+	return
+}
+
+func githubRevision(getenv func(string) string) (revision CIRevision, ok bool) {
+	if getenv("GITHUB_ACTIONS") != "true" {
+		return
+	}
+
+	ref := getenv("GITHUB_REF")
+
+	switch {
+	case len(getenv("GITHUB_HEAD_REF")) > 0:
+		// pull requests are built at refs/pull/<n>/merge
+		revision.Branch = getenv("GITHUB_HEAD_REF")
+	case strings.HasPrefix(ref, "refs/heads/"):
+		revision.Branch = strings.TrimPrefix(ref, "refs/heads/")
+	case strings.HasPrefix(ref, "refs/tags/"):
+		revision.Tag = strings.TrimPrefix(ref, "refs/tags/")
+	}
+
+	revision.SHA = getenv("GITHUB_SHA")
+	revision.BuildNumber = getenv("GITHUB_RUN_NUMBER")
+	ok = true
+
+	return
+}
+
+func gitlabRevision(getenv func(string) string) (revision CIRevision, ok bool) {
+	if getenv("GITLAB_CI") != "true" {
+		return
+	}
+
+	revision = CIRevision{
+		Branch:      getenv("CI_COMMIT_BRANCH"),
+		Tag:         getenv("CI_COMMIT_TAG"),
+		SHA:         getenv("CI_COMMIT_SHA"),
+		BuildNumber: getenv("CI_PIPELINE_IID"),
+	}
+
+	// merge request pipelines have no CI_COMMIT_BRANCH
+	if len(revision.Branch) == 0 && len(revision.Tag) == 0 {
+		revision.Branch = getenv("CI_MERGE_REQUEST_SOURCE_BRANCH_NAME")
+	}
+
+	ok = true
+
+	return
+}
+
+func jenkinsRevision(getenv func(string) string) (revision CIRevision, ok bool) {
+	if len(getenv("JENKINS_URL")) == 0 {
+		return
+	}
+
+	revision = CIRevision{
+		Branch:      getenv("BRANCH_NAME"),
+		Tag:         getenv("TAG_NAME"),
+		SHA:         getenv("GIT_COMMIT"),
+		BuildNumber: getenv("BUILD_NUMBER"),
+	}
+
+	// multibranch pipelines set BRANCH_NAME, the git plugin sets GIT_BRANCH
+	// such as origin/master, a tag build has BRANCH_NAME of the tag
+	if len(revision.Tag) > 0 && revision.Branch == revision.Tag {
+		revision.Branch = ""
+	} else if len(revision.Branch) == 0 {
+		revision.Branch = strings.TrimPrefix(getenv("GIT_BRANCH"), "origin/")
+	}
+
+	ok = true
+
+	return
+}
+
+func droneRevision(getenv func(string) string) (revision CIRevision, ok bool) {
+	if getenv("DRONE") != "true" {
+		return
+	}
+
+	revision = CIRevision{
+		Tag:         getenv("DRONE_TAG"),
+		SHA:         getenv("DRONE_COMMIT_SHA"),
+		BuildNumber: getenv("DRONE_BUILD_NUMBER"),
+	}
+
+	// DRONE_BRANCH of a pull request is the target branch
+	if len(revision.Tag) == 0 {
+		revision.Branch = getenv("DRONE_SOURCE_BRANCH")
+		if len(revision.Branch) == 0 {
+			revision.Branch = getenv("DRONE_BRANCH")
+		}
+	}
+
+	ok = true
+
+	return
+}
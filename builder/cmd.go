@@ -7,9 +7,27 @@ import (
 	"strings"
 )
 
-func execCommandToShow(cwd string, cmdStr string) (err error) {
+// Runner runs the external commands of Builder, such as git and local go build
+type Runner interface {
+	// Run runs the command in cwd with its output shown
+	Run(cwd string, args ...string) error
+	// Output runs the command in cwd and returns its combined output
+	Output(cwd string, args ...string) ([]byte, error)
+}
+
+// ExecRunner is the default Runner, it runs commands by os/exec
+type ExecRunner struct{}
+
+func (ExecRunner) Run(cwd string, args ...string) error {
+	return execCommandToShow(cwd, args)
+}
+
+func (ExecRunner) Output(cwd string, args ...string) ([]byte, error) {
+	return execCommand(cwd, args)
+}
+
+func execCommandToShow(cwd string, parts []string) (err error) {
 
-	parts := strings.Fields(cmdStr)
 	name := parts[0]
 	args := parts[1:len(parts)]
 
@@ -43,9 +61,8 @@ func execCommandToShow(cwd string, cmdStr string) (err error) {
 	return
 }
 
-func execCommand(cwd string, cmdStr string) (out []byte, err error) {
+func execCommand(cwd string, parts []string) (out []byte, err error) {
 
-	parts := strings.Fields(cmdStr)
 	name := parts[0]
 	args := parts[1:len(parts)]
 
@@ -57,3 +74,22 @@ func execCommand(cwd string, cmdStr string) (out []byte, err error) {
 
 	return cmd.CombinedOutput()
 }
+
+// shellJoin joins args into a command line for logging, args with spaces
+// or shell special chars are single quoted, credentials are redacted by
+// redactArgs
+func shellJoin(args []string) string {
+	args = redactArgs(args)
+
+	quoted := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) == 0 {
+			arg = "''"
+		} else if strings.ContainsAny(arg, " \t\n'\"\\$`!*?[]{}()<>|&;#~") {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -1,13 +1,116 @@
 package builder
 
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
 type BranchTag struct {
-	Server       string   `json:"server"`
-	Username     string   `json:"username"`
-	Password     string   `json:"password"`
-	Organization string   `json:"organization"`
-	Tags         []string `json:"tags"`
+	Server       string   `json:"server" yaml:"server" toml:"server"`
+	Username     string   `json:"username" yaml:"username" toml:"username"`
+	Password     string   `json:"password" yaml:"password" toml:"password"`
+	Organization string   `json:"organization" yaml:"organization" toml:"organization"`
+	Tags         []string `json:"tags" yaml:"tags" toml:"tags"`
+	// Dirty is what to do with a dirty working tree, DirtySuffix by default
+	Dirty string `json:"dirty" yaml:"dirty" toml:"dirty"`
 }
 
 type BranchTagsConfig struct {
-	Branchs map[string]BranchTag `branchs`
+	Branchs map[string]BranchTag `json:"branchs" yaml:"branchs" toml:"branchs"`
+}
+
+const (
+	// DefaultBranch is the key of the branch config used when no key matches
+	DefaultBranch = "default"
+)
+
+// policies of a dirty working tree
+const (
+	// DirtySuffix appends -dirty to the image tags
+	DirtySuffix = "suffix"
+	// DirtyRefuse refuses to push images built from a dirty tree
+	DirtyRefuse = "refuse"
+)
+
+func validateDirtyPolicy(policy string) (err error) {
+	switch policy {
+	case "", DirtySuffix, DirtyRefuse:
+	default:
+		err = fmt.Errorf("unknown dirty policy %q, it should be %s or %s", policy, DirtySuffix, DirtyRefuse)
+	}
+	return
+}
+
+// Match returns the config of branch and the key it matched, keys could be
+// exact branch names, globs such as feature/* (path.Match syntax) or regexps
+// wrapped in slashes such as /^release-\d+$/, the precedence is:
+// exact > longest glob > regexp > default
+func (p BranchTagsConfig) Match(branch string) (branchTag BranchTag, pattern string, exist bool, err error) {
+	if branchTag, exist = p.Branchs[branch]; exist {
+		pattern = branch
+		return
+	}
+
+	var keys []string
+	for key := range p.Branchs {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for i := 0; i < len(keys); i++ {
+		if isRegexpBranchKey(keys[i]) || !isGlobBranchKey(keys[i]) {
+			continue
+		}
+
+		var matched bool
+		if matched, err = path.Match(keys[i], branch); err != nil {
+			err = fmt.Errorf("bad branch pattern %q: %s", keys[i], err)
+			return
+		}
+
+		if matched && len(keys[i]) > len(pattern) {
+			pattern = keys[i]
+			exist = true
+		}
+	}
+
+	if exist {
+		branchTag = p.Branchs[pattern]
+		return
+	}
+
+	for i := 0; i < len(keys); i++ {
+		if !isRegexpBranchKey(keys[i]) {
+			continue
+		}
+
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(keys[i][1 : len(keys[i])-1]); err != nil {
+			err = fmt.Errorf("bad branch pattern %q: %s", keys[i], err)
+			return
+		}
+
+		if re.MatchString(branch) {
+			branchTag, pattern, exist = p.Branchs[keys[i]], keys[i], true
+			return
+		}
+	}
+
+	if branchTag, exist = p.Branchs[DefaultBranch]; exist {
+		pattern = DefaultBranch
+	}
+
+	return
+}
+
+func isRegexpBranchKey(key string) bool {
+	return len(key) > 2 && strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/")
+}
+
+func isGlobBranchKey(key string) bool {
+	return strings.ContainsAny(key, "*?[")
 }
@@ -0,0 +1,265 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	secretFilePrefix = "file:"
+	dockerHubServer  = "https://index.docker.io/v1/"
+)
+
+var secretEnvRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ResolveSecret resolves a username or password value of config, ${NAME}
+// is replaced by env var NAME, then a value like file:path is the trimmed
+// content of the file, relative paths are relative to dir
+func ResolveSecret(value, dir string, getenv func(string) string) (secret string, err error) {
+	secret = secretEnvRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+		name := secretEnvRegexp.FindStringSubmatch(ref)[1]
+		v := getenv(name)
+		if len(v) == 0 && err == nil {
+			err = fmt.Errorf("env var %s of secret is not set", name)
+		}
+		return v
+	})
+
+	if err != nil || !strings.HasPrefix(secret, secretFilePrefix) {
+		return
+	}
+
+	filename := strings.TrimPrefix(secret, secretFilePrefix)
+	if strings.HasPrefix(filename, "~/") {
+		filename = filepath.Join(getenv("HOME"), filename[2:])
+	} else if !filepath.IsAbs(filename) {
+		filename = filepath.Join(dir, filename)
+	}
+
+	var data []byte
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		err = fmt.Errorf("read secret file failure: %s", err)
+		return
+	}
+
+	secret = strings.TrimRight(string(data), "\r\n")
+
+	return
+}
+
+// DockerConfigFile is the part of ~/.docker/config.json about credentials
+type DockerConfigFile struct {
+	Auths       map[string]DockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore,omitempty"`
+	CredHelpers map[string]string           `json:"credHelpers,omitempty"`
+}
+
+type DockerConfigAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// dockerConfigDir is $DOCKER_CONFIG or ~/.docker
+func dockerConfigDir(getenv func(string) string) string {
+	if dir := getenv("DOCKER_CONFIG"); len(dir) > 0 {
+		return dir
+	}
+	return filepath.Join(getenv("HOME"), ".docker")
+}
+
+// credentialHelperGet runs docker-credential-<helper> get, it is a var so
+// that it could be replaced in tests
+var credentialHelperGet = func(helper, server string) (out []byte, err error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+
+	if out, err = cmd.Output(); err != nil {
+		// helpers print the error to stdout
+		err = fmt.Errorf("%s, %s", err, strings.TrimSpace(string(out)+" "+stderr.String()))
+	}
+
+	return
+}
+
+// lookupDockerCredentials finds the credentials of server in the docker
+// config, by credHelpers of the server, auths entry, then credsStore
+func lookupDockerCredentials(server string, getenv func(string) string) (auth RegistryAuth, found bool, err error) {
+	filename := filepath.Join(dockerConfigDir(getenv), "config.json")
+
+	var data []byte
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var config DockerConfigFile
+	if err = json.Unmarshal(data, &config); err != nil {
+		err = fmt.Errorf("parse %s failure: %s", filename, err)
+		return
+	}
+
+	if len(server) == 0 {
+		server = dockerHubServer
+	}
+
+	if helper, exist := config.CredHelpers[registryHostname(server)]; exist {
+		logger.Debugf("registry credentials of %s are read from credential helper %s", server, helper)
+		return credentialsFromHelper(helper, server)
+	}
+
+	for key, entry := range config.Auths {
+		if registryHostname(key) != registryHostname(server) {
+			continue
+		}
+
+		if auth, err = entry.registryAuth(); err != nil {
+			err = fmt.Errorf("bad auth of %s in %s: %s", key, filename, err)
+			return
+		}
+
+		// docker login with a credsStore leaves an empty entry
+		if len(auth.Username) > 0 || len(auth.IdentityToken) > 0 {
+			logger.Debugf("registry credentials of %s are read from %s", server, filename)
+			auth.ServerAddress = server
+			found = true
+			return
+		}
+	}
+
+	if len(config.CredsStore) > 0 {
+		logger.Debugf("registry credentials of %s are read from credential store %s", server, config.CredsStore)
+		return credentialsFromHelper(config.CredsStore, server)
+	}
+
+	return
+}
+
+func (p DockerConfigAuth) registryAuth() (auth RegistryAuth, err error) {
+	auth = RegistryAuth{
+		Username:      p.Username,
+		Password:      p.Password,
+		IdentityToken: p.IdentityToken,
+	}
+
+	if len(p.Auth) == 0 {
+		return
+	}
+
+	var data []byte
+	if data, err = base64.StdEncoding.DecodeString(p.Auth); err != nil {
+		return
+	}
+
+	kv := strings.SplitN(string(data), ":", 2)
+	if len(kv) != 2 {
+		err = errors.New("auth should be base64 of username:password")
+		return
+	}
+
+	auth.Username, auth.Password = kv[0], kv[1]
+
+	return
+}
+
+func credentialsFromHelper(helper, server string) (auth RegistryAuth, found bool, err error) {
+	var out []byte
+	if out, err = credentialHelperGet(helper, server); err != nil {
+		if strings.Contains(err.Error(), "credentials not found") {
+			err = nil
+			return
+		}
+		err = fmt.Errorf("docker-credential-%s get failure: %s", helper, err)
+		return
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+
+	if err = json.Unmarshal(out, &creds); err != nil {
+		err = fmt.Errorf("parse output of docker-credential-%s failure: %s", helper, err)
+		return
+	}
+
+	auth.ServerAddress = server
+
+	// helpers return the username <token> for identity tokens
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+
+	found = true
+
+	return
+}
+
+// registryHostname strips the scheme and path of a registry address, so
+// https://index.docker.io/v1/ and index.docker.io are the same key
+func registryHostname(server string) string {
+	host := server
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	if host == "docker.io" || host == "registry-1.docker.io" {
+		host = "index.docker.io"
+	}
+	return strings.ToLower(host)
+}
+
+// resolveRegistryAuth resolves the secrets of username and password, and
+// looks up the docker config if no password is configured
+func (p *Builder) resolveRegistryAuth(getenv func(string) string) (err error) {
+	if p.Options.RegistryUsername, err = ResolveSecret(p.Options.RegistryUsername, p.Options.WorkDir, getenv); err != nil {
+		err = fmt.Errorf("resolve registry username failure: %s", err)
+		return
+	}
+
+	if p.Options.RegistryPassword, err = ResolveSecret(p.Options.RegistryPassword, p.Options.WorkDir, getenv); err != nil {
+		err = fmt.Errorf("resolve registry password failure: %s", err)
+		return
+	}
+
+	// docker credential helpers are commands, a dry run runs none
+	if len(p.Options.RegistryPassword) > 0 || p.dryRun() {
+		return
+	}
+
+	var auth RegistryAuth
+	var found bool
+	if auth, found, err = lookupDockerCredentials(p.Options.RegistryHost, getenv); err != nil || !found {
+		return
+	}
+
+	if len(p.Options.RegistryUsername) > 0 && len(auth.Username) > 0 && auth.Username != p.Options.RegistryUsername {
+		logger.Warnf("registry username %s differs from %s in docker config, it is not used", p.Options.RegistryUsername, auth.Username)
+		return
+	}
+
+	p.Options.RegistryUsername = auth.Username
+	p.Options.RegistryPassword = auth.Password
+	p.Options.RegistryIdentityToken = auth.IdentityToken
+
+	return
+}
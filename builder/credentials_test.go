@@ -0,0 +1,303 @@
+package builder
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// stubCredentialHelpers replaces docker-credential-<helper> get by outputs
+// keyed by "<helper> <server>", the calls are recorded
+func stubCredentialHelpers(t *testing.T, outputs map[string]string, errs map[string]error) (calls *[]string) {
+	calls = new([]string)
+
+	get := credentialHelperGet
+	t.Cleanup(func() { credentialHelperGet = get })
+
+	credentialHelperGet = func(helper, server string) ([]byte, error) {
+		key := helper + " " + server
+		*calls = append(*calls, key)
+		if err, exist := errs[key]; exist {
+			return nil, err
+		}
+		return []byte(outputs[key]), nil
+	}
+
+	return
+}
+
+func mapEnv(env map[string]string) func(string) string {
+	return func(name string) string {
+		return env[name]
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		env     map[string]string
+		files   map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "plain",
+			value: "secret",
+			want:  "secret",
+		},
+		{
+			name:  "env",
+			value: "${REGISTRY_USER}-${REGISTRY_SUFFIX}",
+			env:   map[string]string{"REGISTRY_USER": "bob", "REGISTRY_SUFFIX": "ci"},
+			want:  "bob-ci",
+		},
+		{
+			name:    "unset env",
+			value:   "${REGISTRY_PASSWORD}",
+			wantErr: "env var REGISTRY_PASSWORD of secret is not set",
+		},
+		{
+			name:  "relative file",
+			value: "file:secrets/password",
+			files: map[string]string{"secrets/password": "s3cret\n"},
+			want:  "s3cret",
+		},
+		{
+			name:  "file of env",
+			value: "file:${SECRETS_DIR}/password",
+			env:   map[string]string{"SECRETS_DIR": "secrets"},
+			files: map[string]string{"secrets/password": "s3cret\r\n"},
+			want:  "s3cret",
+		},
+		{
+			name:  "home file",
+			value: "file:~/.registry-password",
+			files: map[string]string{"home/.registry-password": "s3cret"},
+			want:  "s3cret",
+		},
+		{
+			name:    "missing file",
+			value:   "file:password",
+			wantErr: "read secret file failure",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			env := map[string]string{"HOME": filepath.Join(dir, "home")}
+			for k, v := range test.env {
+				env[k] = v
+			}
+
+			for name, content := range test.files {
+				filename := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			secret, err := ResolveSecret(test.value, dir, mapEnv(env))
+			if checkErr(t, err, test.wantErr) {
+				return
+			}
+
+			if secret != test.want {
+				t.Errorf("secret = %q, want %q", secret, test.want)
+			}
+		})
+	}
+}
+
+func TestLookupDockerCredentials(t *testing.T) {
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("bob:secret"))
+
+	tests := []struct {
+		name        string
+		config      string
+		server      string
+		helpers     map[string]string
+		helperErrs  map[string]error
+		wantAuth    RegistryAuth
+		wantFound   bool
+		wantHelpers []string
+		wantErr     string
+	}{
+		{
+			name:   "no config",
+			server: "registry.example.com",
+		},
+		{
+			name:      "auths",
+			config:    `{"auths": {"https://registry.example.com/v2/": {"auth": "` + basicAuth + `"}}}`,
+			server:    "registry.example.com",
+			wantAuth:  RegistryAuth{Username: "bob", Password: "secret", ServerAddress: "registry.example.com"},
+			wantFound: true,
+		},
+		{
+			name:      "auths of docker hub",
+			config:    `{"auths": {"https://index.docker.io/v1/": {"username": "bob", "password": "secret"}}}`,
+			wantAuth:  RegistryAuth{Username: "bob", Password: "secret", ServerAddress: dockerHubServer},
+			wantFound: true,
+		},
+		{
+			name:   "auths of other server",
+			config: `{"auths": {"other.example.com": {"auth": "` + basicAuth + `"}}}`,
+			server: "registry.example.com",
+		},
+		{
+			name:        "cred helper before auths",
+			config:      `{"auths": {"registry.example.com": {"auth": "` + basicAuth + `"}}, "credHelpers": {"registry.example.com": "ecr-login"}, "credsStore": "desktop"}`,
+			server:      "registry.example.com",
+			helpers:     map[string]string{"ecr-login registry.example.com": `{"Username": "AWS", "Secret": "token"}`},
+			wantAuth:    RegistryAuth{Username: "AWS", Password: "token", ServerAddress: "registry.example.com"},
+			wantFound:   true,
+			wantHelpers: []string{"ecr-login registry.example.com"},
+		},
+		{
+			name:      "auths before creds store",
+			config:    `{"auths": {"registry.example.com": {"auth": "` + basicAuth + `"}}, "credsStore": "desktop"}`,
+			server:    "registry.example.com",
+			wantAuth:  RegistryAuth{Username: "bob", Password: "secret", ServerAddress: "registry.example.com"},
+			wantFound: true,
+		},
+		{
+			name:        "creds store of empty auths",
+			config:      `{"auths": {"registry.example.com": {}}, "credsStore": "desktop"}`,
+			server:      "registry.example.com",
+			helpers:     map[string]string{"desktop registry.example.com": `{"Username": "<token>", "Secret": "identity"}`},
+			wantAuth:    RegistryAuth{IdentityToken: "identity", ServerAddress: "registry.example.com"},
+			wantFound:   true,
+			wantHelpers: []string{"desktop registry.example.com"},
+		},
+		{
+			name:        "credentials not found",
+			config:      `{"credsStore": "desktop"}`,
+			server:      "registry.example.com",
+			helperErrs:  map[string]error{"desktop registry.example.com": errors.New("exit status 1, credentials not found in native keychain")},
+			wantHelpers: []string{"desktop registry.example.com"},
+		},
+		{
+			name:        "helper failure",
+			config:      `{"credsStore": "desktop"}`,
+			server:      "registry.example.com",
+			helperErrs:  map[string]error{"desktop registry.example.com": errors.New("exit status 1, keychain locked")},
+			wantHelpers: []string{"desktop registry.example.com"},
+			wantErr:     "docker-credential-desktop get failure",
+		},
+		{
+			name:    "bad auth",
+			config:  `{"auths": {"registry.example.com": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("bob")) + `"}}}`,
+			server:  "registry.example.com",
+			wantErr: "auth should be base64 of username:password",
+		},
+		{
+			name:    "bad config",
+			config:  `{"auths": [}`,
+			server:  "registry.example.com",
+			wantErr: "config.json failure",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if len(test.config) > 0 {
+				if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(test.config), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			calls := stubCredentialHelpers(t, test.helpers, test.helperErrs)
+
+			auth, found, err := lookupDockerCredentials(test.server, mapEnv(map[string]string{"DOCKER_CONFIG": dir}))
+
+			if !reflect.DeepEqual(*calls, test.wantHelpers) {
+				t.Errorf("credential helpers called = %q, want %q", *calls, test.wantHelpers)
+			}
+
+			if checkErr(t, err, test.wantErr) {
+				return
+			}
+
+			if found != test.wantFound || auth != test.wantAuth {
+				t.Errorf("credentials = %+v %v, want %+v %v", auth, found, test.wantAuth, test.wantFound)
+			}
+		})
+	}
+}
+
+func TestResolveRegistryAuth(t *testing.T) {
+	config := `{"auths": {"registry.example.com": {}}, "credsStore": "desktop"}`
+
+	tests := []struct {
+		name        string
+		options     BuildOptions
+		dryRun      bool
+		wantOptions BuildOptions
+		wantHelpers []string
+	}{
+		{
+			name:        "docker config",
+			options:     BuildOptions{RegistryHost: "registry.example.com"},
+			wantOptions: BuildOptions{RegistryHost: "registry.example.com", RegistryUsername: "bob", RegistryPassword: "secret"},
+			wantHelpers: []string{"desktop registry.example.com"},
+		},
+		{
+			name:        "password of options",
+			options:     BuildOptions{RegistryHost: "registry.example.com", RegistryUsername: "${REGISTRY_USER}", RegistryPassword: "pass"},
+			wantOptions: BuildOptions{RegistryHost: "registry.example.com", RegistryUsername: "alice", RegistryPassword: "pass"},
+		},
+		{
+			name:        "other username of docker config",
+			options:     BuildOptions{RegistryHost: "registry.example.com", RegistryUsername: "alice"},
+			wantOptions: BuildOptions{RegistryHost: "registry.example.com", RegistryUsername: "alice"},
+			wantHelpers: []string{"desktop registry.example.com"},
+		},
+		{
+			name:        "dry run",
+			options:     BuildOptions{RegistryHost: "registry.example.com"},
+			dryRun:      true,
+			wantOptions: BuildOptions{RegistryHost: "registry.example.com"},
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			calls := stubCredentialHelpers(t, map[string]string{"desktop registry.example.com": `{"Username": "bob", "Secret": "secret"}`}, nil)
+
+			builder := &Builder{Options: test.options}
+			if test.dryRun {
+				builder.Plan = &Plan{}
+			}
+
+			if err := builder.resolveRegistryAuth(mapEnv(map[string]string{"DOCKER_CONFIG": dir, "REGISTRY_USER": "alice"})); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(builder.Options, test.wantOptions) {
+				t.Errorf("options = %+v, want %+v", builder.Options, test.wantOptions)
+			}
+
+			if !reflect.DeepEqual(*calls, test.wantHelpers) {
+				t.Errorf("credential helpers called = %q, want %q", *calls, test.wantHelpers)
+			}
+		})
+	}
+}
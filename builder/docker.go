@@ -0,0 +1,171 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DockerClient is the docker daemon operations used by Builder
+type DockerClient interface {
+	// BuildImage builds contextDir with the Dockerfile in it and returns the image id
+	BuildImage(contextDir string, options ImageBuildOptions) (imageID string, err error)
+	// TagImage tags image as ref
+	TagImage(image, ref string) error
+	// PushImage pushes ref to its registry and returns the pushed manifest digest
+	PushImage(ref string, auth RegistryAuth) (digest string, err error)
+	// RemoveImage removes the image of ref
+	RemoveImage(ref string, force bool) error
+	// SaveImage writes the images of refs into filename as a docker-archive
+	SaveImage(refs []string, filename string) error
+	// LoadImage loads the images of the docker-archive filename
+	LoadImage(filename string) error
+	// RunContainer runs a container until it exits, a non zero exit code is
+	// returned as *ContainerExitError
+	RunContainer(config ContainerConfig) error
+}
+
+type ImageBuildOptions struct {
+	Tags       []string
+	Platform   string
+	Dockerfile string
+	Labels     map[string]string
+	BuildArgs  map[string]string
+	// DockerfileContent is added into the build context as Dockerfile if
+	// it is not empty, instead of a file in the context dir
+	DockerfileContent []byte
+	// Exclude are the .dockerignore patterns of paths which are not sent,
+	// they are added after the patterns of .dockerignore in the context dir
+	Exclude []string
+}
+
+type RegistryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// Mount is a bind mount of host path, or a named volume mount, they are not
+// joined as -v src:dst so paths could contain colons and commas
+type Mount struct {
+	Type   string `json:"Type"`
+	Source string `json:"Source"`
+	Target string `json:"Target"`
+}
+
+// String is the --mount value of docker run, fields with commas are quoted
+func (m Mount) String() string {
+	fields := []string{"type=" + m.Type, "source=" + m.Source, "target=" + m.Target}
+	for i := 0; i < len(fields); i++ {
+		if strings.ContainsAny(fields[i], ",\"") {
+			fields[i] = "\"" + strings.Replace(fields[i], "\"", "\"\"", -1) + "\""
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+func BindMount(source, target string) Mount {
+	return Mount{Type: "bind", Source: source, Target: target}
+}
+
+func VolumeMount(name, target string) Mount {
+	return Mount{Type: "volume", Source: name, Target: target}
+}
+
+type ContainerConfig struct {
+	Image      string
+	Cmd        []string
+	Env        []string
+	User       string
+	WorkingDir string
+	Mounts     []Mount
+	Privileged bool
+	Stdout     io.Writer
+	Stderr     io.Writer
+}
+
+// Args is the docker run command line of the container, for logging
+func (c ContainerConfig) Args() []string {
+	args := []string{"docker", "run", "--rm"}
+
+	if c.Privileged {
+		args = append(args, "--privileged")
+	}
+
+	if len(c.User) > 0 {
+		args = append(args, "-u", c.User)
+	}
+
+	for i := 0; i < len(c.Mounts); i++ {
+		args = append(args, "--mount", c.Mounts[i].String())
+	}
+
+	for i := 0; i < len(c.Env); i++ {
+		args = append(args, "-e", c.Env[i])
+	}
+
+	if len(c.WorkingDir) > 0 {
+		args = append(args, "-w", c.WorkingDir)
+	}
+
+	args = append(args, c.Image)
+	args = append(args, c.Cmd...)
+
+	return args
+}
+
+// DockerError is an error response of docker engine api
+type DockerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *DockerError) Error() string {
+	return fmt.Sprintf("docker: %s (status code: %d)", e.Message, e.StatusCode)
+}
+
+// StreamError is an error reported in the json progress stream of build or push
+type StreamError struct {
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	return "docker: " + e.Message
+}
+
+// ContainerExitError is returned when a container exits with non zero code
+type ContainerExitError struct {
+	Image    string
+	ExitCode int
+}
+
+func (e *ContainerExitError) Error() string {
+	return fmt.Sprintf("container of %s exited with code %d", e.Image, e.ExitCode)
+}
+
+// IsErrNotFound returns true if err is a docker or registry not found
+// error, e.g: no such image, manifest unknown
+func IsErrNotFound(err error) bool {
+	if e, ok := err.(*DockerError); ok {
+		return e.StatusCode == 404
+	}
+	if e, ok := err.(*RegistryError); ok {
+		return e.StatusCode == 404
+	}
+	return false
+}
+
+// splitImageRef splits ref into repository and tag, tag is empty if ref has no tag
+func splitImageRef(ref string) (repo, tag string) {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		return ref[:i], ""
+	}
+
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i+1:], "/") {
+		return ref, ""
+	}
+
+	return ref[:i], ref[i+1:]
+}
@@ -0,0 +1,644 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultDockerHost = "unix:///var/run/docker.sock"
+)
+
+// EngineClient is a DockerClient talking to docker engine api
+type EngineClient struct {
+	// Output is where the build, push and pull progress goes, default is os.Stdout
+	Output io.Writer
+
+	host   string
+	client *http.Client
+}
+
+// NewEngineClient creates a docker engine api client of host, such as
+// unix:///var/run/docker.sock or tcp://127.0.0.1:2376, $DOCKER_HOST is used
+// if host is empty, tcp hosts use TLS like the docker cli by
+// $DOCKER_TLS_VERIFY and $DOCKER_CERT_PATH
+func NewEngineClient(host string) (c *EngineClient, err error) {
+	return newEngineClient(host, os.Getenv)
+}
+
+func newEngineClient(host string, getenv func(string) string) (c *EngineClient, err error) {
+	if len(host) == 0 {
+		host = getenv("DOCKER_HOST")
+	}
+
+	if len(host) == 0 {
+		host = defaultDockerHost
+	}
+
+	var u *url.URL
+	if u, err = url.Parse(host); err != nil {
+		return
+	}
+
+	transport := &http.Transport{}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		host = "http://docker"
+	case "tcp", "http", "https":
+		host = "http://" + u.Host
+
+		if u.Scheme == "http" {
+			break
+		}
+
+		if transport.TLSClientConfig, err = engineTLSConfig(u.Scheme == "https", getenv); err != nil {
+			return
+		}
+
+		if transport.TLSClientConfig != nil {
+			host = "https://" + u.Host
+		}
+	default:
+		err = fmt.Errorf("unsupported docker host: %s", host)
+		return
+	}
+
+	c = &EngineClient{
+		Output: os.Stdout,
+		host:   host,
+		client: &http.Client{Transport: transport},
+	}
+
+	return
+}
+
+// engineTLSConfig returns the TLS config of tcp docker hosts, TLS is used if
+// $DOCKER_TLS_VERIFY or $DOCKER_CERT_PATH is set or the scheme is https, the
+// server is verified by ca.pem of the cert path if $DOCKER_TLS_VERIFY is set,
+// and cert.pem and key.pem are the client certificate if they exist, the
+// cert path is ~/.docker by default
+func engineTLSConfig(https bool, getenv func(string) string) (config *tls.Config, err error) {
+	verify := len(getenv("DOCKER_TLS_VERIFY")) > 0
+	certPath := getenv("DOCKER_CERT_PATH")
+
+	if !https && !verify && len(certPath) == 0 {
+		return
+	}
+
+	if len(certPath) == 0 {
+		certPath = dockerConfigDir(getenv)
+	}
+
+	config = &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: !verify}
+
+	if verify {
+		var ca []byte
+		if ca, err = ioutil.ReadFile(filepath.Join(certPath, "ca.pem")); err != nil {
+			err = fmt.Errorf("read ca certificate of $DOCKER_TLS_VERIFY failure, it should be ca.pem in $DOCKER_CERT_PATH: %s", err)
+			return
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			err = fmt.Errorf("no certificate in %s", filepath.Join(certPath, "ca.pem"))
+			return
+		}
+	}
+
+	certFile := filepath.Join(certPath, "cert.pem")
+	keyFile := filepath.Join(certPath, "key.pem")
+
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return
+	}
+
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		err = fmt.Errorf("load client certificate of docker host failure, it should be cert.pem and key.pem in %s: %s", certPath, err)
+		return
+	}
+
+	config.Certificates = []tls.Certificate{cert}
+
+	return
+}
+
+func (p *EngineClient) BuildImage(contextDir string, options ImageBuildOptions) (imageID string, err error) {
+	query := url.Values{}
+	for i := 0; i < len(options.Tags); i++ {
+		query.Add("t", options.Tags[i])
+	}
+
+	if len(options.Platform) > 0 {
+		query.Set("platform", options.Platform)
+	}
+
+	if len(options.Dockerfile) > 0 {
+		query.Set("dockerfile", options.Dockerfile)
+	}
+
+	if len(options.Labels) > 0 {
+		data, _ := json.Marshal(options.Labels)
+		query.Set("labels", string(data))
+	}
+
+	if len(options.BuildArgs) > 0 {
+		data, _ := json.Marshal(options.BuildArgs)
+		query.Set("buildargs", string(data))
+	}
+
+	query.Set("rm", "1")
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarBuildContext(contextDir, options, pw))
+	}()
+
+	var resp *http.Response
+	if resp, err = p.do("POST", "/build", query, pr, map[string]string{"Content-Type": "application/x-tar"}); err != nil {
+		pr.Close()
+		return
+	}
+	defer resp.Body.Close()
+
+	err = decodeJSONMessages(resp.Body, p.Output, func(aux json.RawMessage) {
+		var result struct {
+			ID string `json:"ID"`
+		}
+		if json.Unmarshal(aux, &result) == nil && len(result.ID) > 0 {
+			imageID = result.ID
+		}
+	})
+
+	return
+}
+
+func (p *EngineClient) TagImage(image, ref string) (err error) {
+	repo, tag := splitImageRef(ref)
+
+	query := url.Values{}
+	query.Set("repo", repo)
+	query.Set("tag", tag)
+
+	var resp *http.Response
+	if resp, err = p.do("POST", "/images/"+image+"/tag", query, nil, nil); err != nil {
+		return
+	}
+
+	resp.Body.Close()
+
+	return
+}
+
+func (p *EngineClient) PushImage(ref string, auth RegistryAuth) (digest string, err error) {
+	repo, tag := splitImageRef(ref)
+
+	query := url.Values{}
+	if len(tag) > 0 {
+		query.Set("tag", tag)
+	}
+
+	authData, _ := json.Marshal(auth)
+
+	headers := map[string]string{
+		"X-Registry-Auth": base64.URLEncoding.EncodeToString(authData),
+	}
+
+	var resp *http.Response
+	if resp, err = p.do("POST", "/images/"+repo+"/push", query, nil, headers); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	err = decodeJSONMessages(resp.Body, p.Output, func(aux json.RawMessage) {
+		var result struct {
+			Digest string `json:"Digest"`
+		}
+		if json.Unmarshal(aux, &result) == nil && len(result.Digest) > 0 {
+			digest = result.Digest
+		}
+	})
+
+	return
+}
+
+func (p *EngineClient) RemoveImage(ref string, force bool) (err error) {
+	query := url.Values{}
+	if force {
+		query.Set("force", "1")
+	}
+
+	var resp *http.Response
+	if resp, err = p.do("DELETE", "/images/"+ref, query, nil, nil); err != nil {
+		return
+	}
+
+	resp.Body.Close()
+
+	return
+}
+
+func (p *EngineClient) SaveImage(refs []string, filename string) (err error) {
+	query := url.Values{}
+	for i := 0; i < len(refs); i++ {
+		query.Add("names", refs[i])
+	}
+
+	var resp *http.Response
+	if resp, err = p.do("GET", "/images/get", query, nil, nil); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var f *os.File
+	if f, err = os.Create(filename); err != nil {
+		return
+	}
+
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return
+	}
+
+	return f.Close()
+}
+
+func (p *EngineClient) LoadImage(filename string) (err error) {
+	var f *os.File
+	if f, err = os.Open(filename); err != nil {
+		return
+	}
+	defer f.Close()
+
+	var resp *http.Response
+	if resp, err = p.do("POST", "/images/load", nil, f, map[string]string{"Content-Type": "application/x-tar"}); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	return decodeJSONMessages(resp.Body, p.Output, nil)
+}
+
+func (p *EngineClient) RunContainer(config ContainerConfig) (err error) {
+
+	createReq := map[string]interface{}{
+		"Image":      config.Image,
+		"Cmd":        config.Cmd,
+		"Env":        config.Env,
+		"User":       config.User,
+		"WorkingDir": config.WorkingDir,
+		"HostConfig": map[string]interface{}{
+			"Mounts":     config.Mounts,
+			"Privileged": config.Privileged,
+		},
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+
+	if err = p.doJSON("POST", "/containers/create", nil, createReq, &created); err != nil {
+		if !IsErrNotFound(err) {
+			return
+		}
+
+		// pull the missing image, then create again
+		query := url.Values{}
+		repo, tag := splitImageRef(config.Image)
+		query.Set("fromImage", repo)
+		if len(tag) == 0 {
+			tag = "latest"
+		}
+		query.Set("tag", tag)
+
+		var resp *http.Response
+		if resp, err = p.do("POST", "/images/create", query, nil, nil); err != nil {
+			return
+		}
+
+		err = decodeJSONMessages(resp.Body, p.Output, nil)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+
+		if err = p.doJSON("POST", "/containers/create", nil, createReq, &created); err != nil {
+			return
+		}
+	}
+
+	defer func() {
+		query := url.Values{}
+		query.Set("force", "1")
+		if resp, e := p.do("DELETE", "/containers/"+created.ID, query, nil, nil); e != nil {
+			logger.Warnln(e)
+		} else {
+			resp.Body.Close()
+		}
+	}()
+
+	if err = p.doJSON("POST", "/containers/"+created.ID+"/start", nil, nil, nil); err != nil {
+		return
+	}
+
+	logsQuery := url.Values{}
+	logsQuery.Set("follow", "1")
+	logsQuery.Set("stdout", "1")
+	logsQuery.Set("stderr", "1")
+
+	var resp *http.Response
+	if resp, err = p.do("GET", "/containers/"+created.ID+"/logs", logsQuery, nil, nil); err != nil {
+		return
+	}
+
+	err = demuxStream(resp.Body, config.Stdout, config.Stderr)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+
+	var waited struct {
+		StatusCode int `json:"StatusCode"`
+	}
+
+	if err = p.doJSON("POST", "/containers/"+created.ID+"/wait", nil, nil, &waited); err != nil {
+		return
+	}
+
+	if waited.StatusCode != 0 {
+		err = &ContainerExitError{Image: config.Image, ExitCode: waited.StatusCode}
+		return
+	}
+
+	return
+}
+
+func (p *EngineClient) do(method, path string, query url.Values, body io.Reader, headers map[string]string) (resp *http.Response, err error) {
+	u := p.host + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequest(method, u, body); err != nil {
+		return
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	if resp, err = p.client.Do(req); err != nil {
+		return
+	}
+
+	if resp.StatusCode >= 400 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		var message struct {
+			Message string `json:"message"`
+		}
+
+		dockerErr := &DockerError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		if json.Unmarshal(data, &message) == nil && len(message.Message) > 0 {
+			dockerErr.Message = message.Message
+		}
+
+		err = dockerErr
+		resp = nil
+		return
+	}
+
+	return
+}
+
+func (p *EngineClient) doJSON(method, path string, query url.Values, in, out interface{}) (err error) {
+	var body io.Reader
+	headers := map[string]string{}
+
+	if in != nil {
+		var data []byte
+		if data, err = json.Marshal(in); err != nil {
+			return
+		}
+		body = bytes.NewReader(data)
+		headers["Content-Type"] = "application/json"
+	}
+
+	var resp *http.Response
+	if resp, err = p.do(method, path, query, body, headers); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jsonMessage is a message of the build, push or pull progress stream
+type jsonMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	ID          string `json:"id"`
+	Progress    string `json:"progress"`
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux json.RawMessage `json:"aux"`
+}
+
+// decodeJSONMessages prints the progress stream to out, and returns the
+// first error message in the stream as *StreamError
+func decodeJSONMessages(r io.Reader, out io.Writer, onAux func(json.RawMessage)) (err error) {
+	if out == nil {
+		out = ioutil.Discard
+	}
+
+	decoder := json.NewDecoder(r)
+
+	for {
+		var msg jsonMessage
+		if err = decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		if msg.ErrorDetail != nil && len(msg.ErrorDetail.Message) > 0 {
+			return &StreamError{Message: msg.ErrorDetail.Message}
+		}
+
+		if len(msg.Error) > 0 {
+			return &StreamError{Message: msg.Error}
+		}
+
+		if len(msg.Aux) > 0 && onAux != nil {
+			onAux(msg.Aux)
+		}
+
+		switch {
+		case len(msg.Stream) > 0:
+			fmt.Fprint(out, msg.Stream)
+		case len(msg.Status) > 0 && len(msg.ID) > 0:
+			fmt.Fprintf(out, "%s: %s %s\n", msg.ID, msg.Status, msg.Progress)
+		case len(msg.Status) > 0:
+			fmt.Fprintln(out, msg.Status)
+		}
+	}
+}
+
+// demuxStream splits the multiplexed logs stream of a container without tty
+func demuxStream(r io.Reader, stdout, stderr io.Writer) (err error) {
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	header := make([]byte, 8)
+
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+
+		out := stdout
+		if header[0] == 2 {
+			out = stderr
+		}
+
+		if _, err = io.CopyN(out, r, size); err != nil {
+			return
+		}
+	}
+}
+
+// tarBuildContext writes dir as a tar stream, it is the build context of
+// docker build, with the Dockerfile of options if it is given, the paths
+// matched by .dockerignore of dir and options.Exclude are not sent
+func tarBuildContext(dir string, options ImageBuildOptions, w io.Writer) (err error) {
+	var patterns []string
+	if patterns, err = readDockerignore(dir); err != nil {
+		return
+	}
+
+	var ignore *ignoreMatcher
+	if ignore, err = newIgnoreMatcher(append(patterns, options.Exclude...)); err != nil {
+		return
+	}
+
+	tw := tar.NewWriter(w)
+
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if ignore.matches(rel) {
+			// !patterns could add back the files of an ignored dir
+			if fi.IsDir() && !ignore.hasExclusions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// sockets, pipes and devices could not be in build context
+		if fi.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice) != 0 {
+			return nil
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+
+		return err
+	})
+
+	if err != nil {
+		return
+	}
+
+	if len(options.DockerfileContent) > 0 {
+		hdr := &tar.Header{Name: options.Dockerfile, Mode: 0644, Size: int64(len(options.DockerfileContent)), Typeflag: tar.TypeReg}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return
+		}
+
+		if _, err = tw.Write(options.DockerfileContent); err != nil {
+			return
+		}
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,184 @@
+package builder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate as cert.pem and
+// key.pem of dir, and returns it
+func writeClientCert(t *testing.T, dir string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePEM(t, filepath.Join(dir, "cert.pem"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(dir, "key.pem"), "EC PRIVATE KEY", keyDER)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func writePEM(t *testing.T, filename, blockType string, der []byte) {
+	if err := os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEngineClientTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+
+	certDir := t.TempDir()
+	clientCert := writeClientCert(t, certDir)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	writePEM(t, filepath.Join(certDir, "ca.pem"), "CERTIFICATE", server.Certificate().Raw)
+
+	host := "tcp://" + strings.TrimPrefix(server.URL, "https://")
+
+	// a cert path without the client certificate
+	caOnlyDir := t.TempDir()
+	writePEM(t, filepath.Join(caOnlyDir, "ca.pem"), "CERTIFICATE", server.Certificate().Raw)
+
+	halfDir := t.TempDir()
+	writeClientCert(t, halfDir)
+	os.Remove(filepath.Join(halfDir, "key.pem"))
+
+	tests := []struct {
+		name       string
+		host       string
+		env        map[string]string
+		wantScheme string
+		wantErr    string
+		wantDoErr  bool
+	}{
+		{
+			name:       "plain tcp",
+			host:       "tcp://127.0.0.1:2375",
+			env:        map[string]string{"HOME": t.TempDir()},
+			wantScheme: "http://",
+		},
+		{
+			name:       "verify",
+			host:       host,
+			env:        map[string]string{"DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": certDir},
+			wantScheme: "https://",
+		},
+		{
+			name:       "verify of docker config dir",
+			host:       host,
+			env:        map[string]string{"DOCKER_TLS_VERIFY": "1", "DOCKER_CONFIG": certDir},
+			wantScheme: "https://",
+		},
+		{
+			name:       "cert path without verify",
+			host:       host,
+			env:        map[string]string{"DOCKER_CERT_PATH": certDir},
+			wantScheme: "https://",
+		},
+		{
+			name:       "no client certificate",
+			host:       host,
+			env:        map[string]string{"DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": caOnlyDir},
+			wantScheme: "https://",
+			wantDoErr:  true,
+		},
+		{
+			name:    "no ca certificate",
+			host:    host,
+			env:     map[string]string{"DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": t.TempDir()},
+			wantErr: "ca.pem in $DOCKER_CERT_PATH",
+		},
+		{
+			name:    "no client key",
+			host:    host,
+			env:     map[string]string{"DOCKER_CERT_PATH": halfDir},
+			wantErr: "cert.pem and key.pem",
+		},
+		{
+			name:       "unix socket",
+			host:       "unix:///var/run/docker.sock",
+			env:        map[string]string{"DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": t.TempDir()},
+			wantScheme: "http://",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			client, err := newEngineClient(test.host, mapEnv(test.env))
+			if checkErr(t, err, test.wantErr) {
+				return
+			}
+
+			if !strings.HasPrefix(client.host, test.wantScheme) {
+				t.Fatalf("host = %s, want the scheme %s", client.host, test.wantScheme)
+			}
+
+			if test.wantScheme != "https://" {
+				return
+			}
+
+			resp, err := client.do("GET", "/_ping", nil, nil, nil)
+			if test.wantDoErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Error("ping without client certificate should fail")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
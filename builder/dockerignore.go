@@ -0,0 +1,159 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const dockerignoreFilename = ".dockerignore"
+
+// ignorePattern is a pattern of .dockerignore, !pattern is an exclusion
+// which adds the matched paths back
+type ignorePattern struct {
+	pattern   string
+	re        *regexp.Regexp
+	exclusion bool
+}
+
+// ignoreMatcher matches the paths of a build context against .dockerignore
+// patterns the way the docker cli does: * and ? do not match /, ** matches
+// any number of dirs, a path is matched if it or one of its parent dirs is,
+// and the last matched pattern wins
+type ignoreMatcher struct {
+	patterns      []ignorePattern
+	hasExclusions bool
+}
+
+// readDockerignore reads the patterns of .dockerignore in dir, there is
+// none if the file does not exist
+func readDockerignore(dir string) (patterns []string, err error) {
+	var f *os.File
+	if f, err = os.Open(filepath.Join(dir, dockerignoreFilename)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	err = scanner.Err()
+
+	return
+}
+
+func newIgnoreMatcher(patterns []string) (matcher *ignoreMatcher, err error) {
+	matcher = &ignoreMatcher{}
+
+	for i := 0; i < len(patterns); i++ {
+		pattern := ignorePattern{pattern: strings.TrimSpace(patterns[i])}
+
+		if strings.HasPrefix(pattern.pattern, "!") {
+			pattern.exclusion = true
+			pattern.pattern = strings.TrimSpace(pattern.pattern[1:])
+			matcher.hasExclusions = true
+		}
+
+		// patterns are relative to the context root, /foo is foo
+		pattern.pattern = strings.TrimPrefix(path.Clean(filepath.ToSlash(pattern.pattern)), "/")
+		if len(pattern.pattern) == 0 || pattern.pattern == "." {
+			continue
+		}
+
+		if pattern.re, err = ignorePatternRegexp(pattern.pattern); err != nil {
+			err = fmt.Errorf("bad %s pattern %q: %s", dockerignoreFilename, patterns[i], err)
+			return
+		}
+
+		matcher.patterns = append(matcher.patterns, pattern)
+	}
+
+	return
+}
+
+// ignorePatternRegexp converts a pattern to a regexp as the pattern matcher
+// of docker does
+func ignorePatternRegexp(pattern string) (*regexp.Regexp, error) {
+	expr := "^"
+
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+
+		switch {
+		case ch == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			i++
+			// **/ matches zero or more dirs
+			if i+1 < len(pattern) && pattern[i+1] == '/' {
+				i++
+			}
+
+			if i+1 == len(pattern) {
+				expr += ".*"
+			} else {
+				expr += "(.*/)?"
+			}
+		case ch == '*':
+			expr += "[^/]*"
+		case ch == '?':
+			expr += "[^/]"
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			expr += regexp.QuoteMeta(string(pattern[i]))
+		case strings.IndexByte(".+()|{}$", ch) >= 0:
+			expr += `\` + string(ch)
+		default:
+			// [a-z] classes are kept
+			expr += string(ch)
+		}
+	}
+
+	return regexp.Compile(expr + "$")
+}
+
+// matches returns whether the slash separated path relative to the context
+// root is ignored
+func (p *ignoreMatcher) matches(rel string) bool {
+	rel = strings.TrimPrefix(path.Clean(filepath.ToSlash(rel)), "/")
+
+	var parents []string
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+	}
+
+	matched := false
+
+	for i := 0; i < len(p.patterns); i++ {
+		pattern := p.patterns[i]
+
+		// an inclusion could not change a matched path, nor an exclusion
+		// an unmatched one
+		if pattern.exclusion != matched {
+			continue
+		}
+
+		match := pattern.re.MatchString(rel)
+		for j := 0; j < len(parents) && !match; j++ {
+			match = pattern.re.MatchString(parents[j])
+		}
+
+		if match {
+			matched = !pattern.exclusion
+		}
+	}
+
+	return matched
+}
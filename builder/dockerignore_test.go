@@ -0,0 +1,113 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		ignored  []string
+		kept     []string
+	}{
+		{
+			name:     "root anchored",
+			patterns: []string{"*.md"},
+			ignored:  []string{"README.md", "/CHANGELOG.md"},
+			kept:     []string{"docs/guide.md", "main.go"},
+		},
+		{
+			name:     "any dir",
+			patterns: []string{"**/*.md"},
+			ignored:  []string{"README.md", "docs/guide.md", "docs/api/v1.md"},
+			kept:     []string{"main.go", "docs/api/v1.go"},
+		},
+		{
+			name:     "trailing any",
+			patterns: []string{"testdata/**"},
+			ignored:  []string{"testdata/a.json", "testdata/golden/b.json"},
+			kept:     []string{"pkg/testdata/a.json"},
+		},
+		{
+			name:     "dir",
+			patterns: []string{"vendor/", "/build"},
+			ignored:  []string{"vendor", "vendor/github.com/pkg/errors/errors.go", "build/app"},
+			kept:     []string{"cmd/vendor/x.go", "builder.go", "pkg/build/app"},
+		},
+		{
+			name:     "re-include",
+			patterns: []string{"docs", "!docs/README.md", "*.md"},
+			ignored:  []string{"docs/guide.md", "docs", "README.md"},
+			kept:     []string{"docs/README.md", "main.go"},
+		},
+		{
+			name:     "last pattern wins",
+			patterns: []string{"!README.md", "*.md"},
+			ignored:  []string{"README.md"},
+		},
+		{
+			name:     "re-include of any dir",
+			patterns: []string{"**/*.json", "!**/package.json"},
+			ignored:  []string{"a.json", "web/tsconfig.json"},
+			kept:     []string{"package.json", "web/package.json"},
+		},
+		{
+			name:     "single char and class",
+			patterns: []string{"app-?", "[0-9]*.log"},
+			ignored:  []string{"app-1", "2018.log"},
+			kept:     []string{"app-10", "app.log"},
+		},
+		{
+			name:     "special chars",
+			patterns: []string{"a+b.(txt)"},
+			ignored:  []string{"a+b.(txt)"},
+			kept:     []string{"aab.(txt)", "a+b.txt"},
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			matcher, err := newIgnoreMatcher(test.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for j := 0; j < len(test.ignored); j++ {
+				if !matcher.matches(test.ignored[j]) {
+					t.Errorf("%s is not ignored by %q", test.ignored[j], test.patterns)
+				}
+			}
+
+			for j := 0; j < len(test.kept); j++ {
+				if matcher.matches(test.kept[j]) {
+					t.Errorf("%s is ignored by %q", test.kept[j], test.patterns)
+				}
+			}
+		})
+	}
+}
+
+func TestReadDockerignore(t *testing.T) {
+	dir := t.TempDir()
+
+	patterns, err := readDockerignore(dir)
+	if err != nil || len(patterns) != 0 {
+		t.Fatalf("patterns of no .dockerignore = %q %v, want none", patterns, err)
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, dockerignoreFilename), []byte("# comment\n\n  *.md  \n!README.md\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if patterns, err = readDockerignore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(patterns) != 2 || patterns[0] != "*.md" || patterns[1] != "!README.md" {
+		t.Errorf("patterns = %q, want [*.md !README.md]", patterns)
+	}
+}
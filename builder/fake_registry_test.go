@@ -0,0 +1,323 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryRegistry is an in-process registry of the registry http api v2 for
+// testing RegistryClient, serve it by httptest.NewServer, it requires token
+// auth if Username is set
+type MemoryRegistry struct {
+	Username string
+	Password string
+
+	// Requests are the recorded requests, such as "PATCH /v2/org/app/blobs/uploads/1"
+	Requests []string
+
+	blobs     map[string][]byte
+	repoBlobs map[string]map[string]bool
+	manifests map[string]map[string]memoryManifest
+	uploads   map[string]*memoryUpload
+	nextID    int
+
+	locker sync.Mutex
+}
+
+type memoryManifest struct {
+	mediaType string
+	data      []byte
+}
+
+type memoryUpload struct {
+	repo string
+	buf  bytes.Buffer
+}
+
+func (p *MemoryRegistry) init() {
+	if p.blobs == nil {
+		p.blobs = map[string][]byte{}
+		p.repoBlobs = map[string]map[string]bool{}
+		p.manifests = map[string]map[string]memoryManifest{}
+		p.uploads = map[string]*memoryUpload{}
+	}
+}
+
+// Blob returns the blob of digest in repo
+func (p *MemoryRegistry) Blob(repo, digest string) (data []byte, exist bool) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.init()
+
+	if !p.repoBlobs[repo][digest] {
+		return
+	}
+
+	data, exist = p.blobs[digest]
+
+	return
+}
+
+// Manifest returns the manifest of ref, a tag or digest, in repo
+func (p *MemoryRegistry) Manifest(repo, ref string) (data []byte, mediaType string, exist bool) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.init()
+
+	m, exist := p.manifests[repo][ref]
+
+	return m.data, m.mediaType, exist
+}
+
+func (p *MemoryRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.init()
+
+	p.Requests = append(p.Requests, r.Method+" "+r.URL.Path)
+
+	if r.URL.Path == "/token" {
+		p.serveToken(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/v2/") {
+		registryError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+
+	if path == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var repo, kind, ref string
+	for _, k := range []string{"/blobs/uploads/", "/blobs/", "/manifests/"} {
+		if i := strings.LastIndex(path+"/", k); i > 0 {
+			repo, kind, ref = path[:i], k, strings.TrimSuffix(path[i+len(k):], "/")
+			break
+		}
+	}
+
+	if len(repo) == 0 {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "unknown path "+r.URL.Path)
+		return
+	}
+
+	if !p.authorized(w, r, repo) {
+		return
+	}
+
+	switch kind {
+	case "/blobs/":
+		p.serveBlob(w, r, repo, ref)
+	case "/blobs/uploads/":
+		p.serveUpload(w, r, repo, ref)
+	case "/manifests/":
+		p.serveManifest(w, r, repo, ref)
+	}
+}
+
+func (p *MemoryRegistry) serveToken(w http.ResponseWriter, r *http.Request) {
+	if username, password, _ := r.BasicAuth(); username != p.Username || password != p.Password {
+		registryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "bad username or password")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"token": "token " + strings.Join(r.URL.Query()["scope"], " "),
+	})
+}
+
+// authorized checks the bearer token has the scope of repo
+func (p *MemoryRegistry) authorized(w http.ResponseWriter, r *http.Request, repo string) bool {
+	if len(p.Username) == 0 {
+		return true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer token ")
+	for _, scope := range strings.Fields(token) {
+		if strings.HasPrefix(scope, "repository:"+repo+":") {
+			return true
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="memory-registry",scope="repository:%s:pull,push"`, r.Host, repo))
+	registryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+
+	return false
+}
+
+func (p *MemoryRegistry) serveBlob(w http.ResponseWriter, r *http.Request, repo, digest string) {
+	data, exist := p.blobs[digest]
+	if !exist || !p.repoBlobs[repo][digest] {
+		registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == "GET" {
+		w.Write(data)
+	}
+}
+
+func (p *MemoryRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch r.Method {
+	case "POST":
+		if digest, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from"); len(digest) > 0 && p.repoBlobs[from][digest] {
+			p.addBlob(repo, digest, p.blobs[digest])
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, digest))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		p.nextID++
+		id = strconv.Itoa(p.nextID)
+		p.uploads[id] = &memoryUpload{repo: repo}
+
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	upload, exist := p.uploads[id]
+	if !exist || upload.repo != repo {
+		registryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+		return
+	}
+
+	if r.Method == "PATCH" {
+		if cr := r.Header.Get("Content-Range"); len(cr) > 0 && !strings.HasPrefix(cr, strconv.Itoa(upload.buf.Len())+"-") {
+			registryError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "bad content range "+cr)
+			return
+		}
+
+		upload.buf.Write(body)
+
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.Header().Set("Range", fmt.Sprintf("0-%d", upload.buf.Len()-1))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if r.Method != "PUT" {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", r.Method)
+		return
+	}
+
+	upload.buf.Write(body)
+
+	digest := r.URL.Query().Get("digest")
+	if digestOf(upload.buf.Bytes()) != digest {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+		return
+	}
+
+	delete(p.uploads, id)
+	p.addBlob(repo, digest, upload.buf.Bytes())
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (p *MemoryRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		m, exist := p.manifests[repo][ref]
+		if !exist {
+			registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digestOf(m.data))
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.data)))
+		w.WriteHeader(http.StatusOK)
+
+		if r.Method == "GET" {
+			w.Write(m.data)
+		}
+		return
+	}
+
+	data, _ := ioutil.ReadAll(r.Body)
+	mediaType := r.Header.Get("Content-Type")
+
+	// the referenced blobs and manifests should be pushed first
+	var refs []string
+	if isIndexMediaType(mediaType) {
+		var index Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			registryError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		for i := 0; i < len(index.Manifests); i++ {
+			if _, exist := p.manifests[repo][index.Manifests[i].Digest]; !exist {
+				registryError(w, http.StatusBadRequest, "MANIFEST_UNKNOWN", "manifest unknown: "+index.Manifests[i].Digest)
+				return
+			}
+		}
+	} else {
+		var manifest Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			registryError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		refs = append(refs, manifest.Config.Digest)
+		for i := 0; i < len(manifest.Layers); i++ {
+			refs = append(refs, manifest.Layers[i].Digest)
+		}
+	}
+
+	for i := 0; i < len(refs); i++ {
+		if !p.repoBlobs[repo][refs[i]] {
+			registryError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown to registry: "+refs[i])
+			return
+		}
+	}
+
+	if p.manifests[repo] == nil {
+		p.manifests[repo] = map[string]memoryManifest{}
+	}
+
+	digest := digestOf(data)
+	p.manifests[repo][ref] = memoryManifest{mediaType: mediaType, data: data}
+	p.manifests[repo][digest] = memoryManifest{mediaType: mediaType, data: data}
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", repo, digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (p *MemoryRegistry) addBlob(repo, digest string, data []byte) {
+	p.blobs[digest] = append([]byte(nil), data...)
+
+	if p.repoBlobs[repo] == nil {
+		p.repoBlobs[repo] = map[string]bool{}
+	}
+	p.repoBlobs[repo][digest] = true
+}
+
+func registryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
@@ -0,0 +1,190 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// RecordedCommand is a command recorded by RecordingRunner
+type RecordedCommand struct {
+	Dir  string
+	Args []string
+}
+
+func (c RecordedCommand) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// RecordingRunner is a fake Runner for testing Builder without git and go,
+// it records the commands instead of running them
+type RecordingRunner struct {
+	// Outputs are the outputs of commands, keyed by the command line
+	Outputs map[string]string
+	// Errors are the errors of commands, keyed by the command line
+	Errors map[string]error
+
+	Commands []RecordedCommand
+
+	locker sync.Mutex
+}
+
+func (p *RecordingRunner) Run(cwd string, args ...string) (err error) {
+	_, err = p.Output(cwd, args...)
+	return
+}
+
+func (p *RecordingRunner) Output(cwd string, args ...string) (out []byte, err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	cmd := RecordedCommand{Dir: cwd, Args: append([]string(nil), args...)}
+	p.Commands = append(p.Commands, cmd)
+
+	return []byte(p.Outputs[cmd.String()]), p.Errors[cmd.String()]
+}
+
+// CommandLines returns the recorded command lines
+func (p *RecordingRunner) CommandLines() []string {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	var lines []string
+	for i := 0; i < len(p.Commands); i++ {
+		lines = append(lines, p.Commands[i].String())
+	}
+
+	return lines
+}
+
+// GitRunner returns a RecordingRunner which answers the git commands of
+// Builder as a repo on branch at revision
+func GitRunner(branch, revision string) *RecordingRunner {
+	return &RecordingRunner{
+		Outputs: map[string]string{
+			"git rev-parse --git-dir":         ".git\n",
+			"git rev-parse --abbrev-ref HEAD": branch + "\n",
+			"git rev-parse HEAD":              revision + "\n",
+		},
+		Errors: map[string]error{
+			"git describe --tags --abbrev=0": errors.New("fatal: No names found, cannot describe anything."),
+		},
+	}
+}
+
+// DockerCall is a call recorded by RecordingDocker
+type DockerCall struct {
+	Method string
+	Args   []string
+}
+
+func (c DockerCall) String() string {
+	return c.Method + " " + strings.Join(c.Args, " ")
+}
+
+// RecordingDocker is a fake DockerClient for testing Builder without docker
+// daemon, image ids and digests are derived from the image refs
+type RecordingDocker struct {
+	// Errors are the errors of calls, keyed by method name, e.g: PushImage
+	Errors map[string]error
+
+	Calls      []DockerCall
+	Builds     []ImageBuildOptions
+	Containers []ContainerConfig
+	// Loaded are the image names of archives loaded by LoadImage
+	Loaded []string
+
+	locker sync.Mutex
+}
+
+func (p *RecordingDocker) record(method string, args ...string) error {
+	p.Calls = append(p.Calls, DockerCall{Method: method, Args: args})
+	return p.Errors[method]
+}
+
+func (p *RecordingDocker) BuildImage(contextDir string, options ImageBuildOptions) (imageID string, err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.Builds = append(p.Builds, options)
+
+	if err = p.record("BuildImage", append([]string{contextDir}, options.Tags...)...); err != nil {
+		return
+	}
+
+	return fakeDigest(strings.Join(options.Tags, ",")), nil
+}
+
+func (p *RecordingDocker) TagImage(image, ref string) error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.record("TagImage", image, ref)
+}
+
+func (p *RecordingDocker) PushImage(ref string, auth RegistryAuth) (digest string, err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if err = p.record("PushImage", ref, auth.ServerAddress, auth.Username); err != nil {
+		return
+	}
+
+	return fakeDigest(ref), nil
+}
+
+func (p *RecordingDocker) RemoveImage(ref string, force bool) error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.record("RemoveImage", ref)
+}
+
+func (p *RecordingDocker) SaveImage(refs []string, filename string) error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.record("SaveImage", append([]string{filename}, refs...)...)
+}
+
+func (p *RecordingDocker) LoadImage(filename string) error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	// the archive is a temp file, its images are read before it is removed
+	if archive, err := OpenImageArchive(filename); err == nil {
+		for i := 0; i < len(archive.Manifests); i++ {
+			p.Loaded = append(p.Loaded, descriptorRefName(archive.Manifests[i]))
+		}
+	}
+
+	return p.record("LoadImage", filename)
+}
+
+func (p *RecordingDocker) RunContainer(config ContainerConfig) error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.Containers = append(p.Containers, config)
+
+	return p.record("RunContainer", config.Args()...)
+}
+
+// CallLines returns the recorded calls
+func (p *RecordingDocker) CallLines() []string {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	var lines []string
+	for i := 0; i < len(p.Calls); i++ {
+		lines = append(lines, p.Calls[i].String())
+	}
+
+	return lines
+}
+
+func fakeDigest(s string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(s)))
+}
@@ -0,0 +1,241 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// BuilderStage is the name of the stage compiling the app in hermetic
+	// builds, the app files are in /go/app of it
+	BuilderStage = "builder"
+	// hermeticDockerfile is the name of the generated Dockerfile in the
+	// build context, it does not overwrite the Dockerfile of the source
+	hermeticDockerfile = ".go-to-docker.Dockerfile"
+	hermeticSrcDir     = "/usr/src/myapp"
+)
+
+// copyFromBuilderRegexp matches the COPY --from=builder of app files
+var copyFromBuilderRegexp = regexp.MustCompile(`(?im)^\s*COPY\s+(?:--\S+\s+)*--from=` + BuilderStage + `\s`)
+
+// checkHermeticDockerfile checks the rendered template takes the app from
+// the builder stage, the ADD . of a template without {{if .Hermetic}} would
+// put the whole source, .git and secrets too, into the app image
+func checkHermeticDockerfile(tmpl string, content []byte) error {
+	if !copyFromBuilderRegexp.Match(content) {
+		return fmt.Errorf("the Dockerfile template %s has no COPY --from=%s, a hermetic build would add the source into the app image, use {{if .Hermetic}}COPY --from=%s /go/app /go/app{{end}} in it", tmpl, BuilderStage, BuilderStage)
+	}
+	return nil
+}
+
+// hermeticSource is the build context of a hermetic build, the source of
+// the module or the workdir
+type hermeticSource struct {
+	contextDir string
+	// workDir is where go build runs in the builder stage
+	workDir string
+	// relDir is the workdir relative to the context dir, slash separated
+	relDir string
+	env    []string
+}
+
+// hermeticSource returns the build context, the module root of go module
+// projects, the workdir of GOPATH projects whose dependencies should be
+// vendored, nothing is mounted from the host
+func (p *Builder) hermeticSource() (src hermeticSource, err error) {
+	modRoot, isModule, useVendor := p.moduleRoot()
+
+	if isModule {
+		var relDir string
+		if relDir, err = filepath.Rel(modRoot, p.Options.WorkDir); err != nil {
+			return
+		}
+
+		src = hermeticSource{
+			contextDir: modRoot,
+			relDir:     filepath.ToSlash(relDir),
+			env:        []string{"GO111MODULE=on"},
+		}
+
+		if useVendor {
+			src.env = append(src.env, "GOFLAGS=-mod=vendor")
+		}
+
+		src.workDir = path.Join(hermeticSrcDir, src.relDir)
+
+		return
+	}
+
+	src = hermeticSource{
+		contextDir: p.Options.WorkDir,
+		relDir:     ".",
+		workDir:    hermeticSrcDir,
+		env:        []string{"GO111MODULE=off"},
+	}
+
+	// keep the import path of the package in GOPATH of builder image
+	if len(p.Options.GoPath) > 0 {
+		if relDir, e := filepath.Rel(filepath.Join(p.Options.GoPath, "src"), p.Options.WorkDir); e == nil && !strings.HasPrefix(relDir, "..") {
+			src.workDir = path.Join("/go/src", filepath.ToSlash(relDir))
+		}
+	}
+
+	return
+}
+
+// builderStage renders the stage which compiles the app and copies the
+// resources into /go/app of the stage, it runs on the platform of the build
+// host and cross compiles, so the builder image is not emulated
+func (p *Builder) builderStage(src hermeticSource, platform *Platform, ldflags string, resPaths []string) (stage []byte, err error) {
+	buf := bytes.NewBuffer(nil)
+
+	fmt.Fprintf(buf, "FROM --platform=$BUILDPLATFORM %s AS %s\n\n", p.Options.BuilderImage, BuilderStage)
+
+	env := src.env
+	if platform != nil {
+		env = append(append([]string(nil), env...), platform.GoEnvs()...)
+	}
+	fmt.Fprintf(buf, "ENV %s\n\n", strings.Join(env, " "))
+
+	srcRoot := src.workDir
+	if src.relDir != "." {
+		srcRoot = strings.TrimSuffix(src.workDir, "/"+src.relDir)
+	}
+
+	fmt.Fprintf(buf, "COPY . %s\n", srcRoot)
+	fmt.Fprintf(buf, "WORKDIR %s\n\n", src.workDir)
+
+	var run []byte
+	if run, err = dockerfileJSON(p.goBuildCommand(path.Join(nativeAppDir, p.Options.AppName), ldflags, false)); err != nil {
+		return
+	}
+	fmt.Fprintf(buf, "RUN %s\n", run)
+
+	for i := 0; i < len(resPaths); i++ {
+		res := filepath.ToSlash(resPaths[i])
+		fmt.Fprintf(buf, "COPY %s %s\n", path.Join(src.relDir, res), path.Join(nativeAppDir, res))
+	}
+
+	buf.WriteString("\n")
+
+	stage = buf.Bytes()
+
+	return
+}
+
+// dockerfileJSON is the exec form of Dockerfile instructions
+func dockerfileJSON(args []string) (data []byte, err error) {
+	return dockerfileJSONValue(args)
+}
+
+// dockerfileJSONValue marshals v without escaping html chars such as &
+func dockerfileJSONValue(v interface{}) (data []byte, err error) {
+	buf := bytes.NewBuffer(nil)
+
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+
+	if err = encoder.Encode(v); err != nil {
+		return
+	}
+
+	data = bytes.TrimSpace(buf.Bytes())
+
+	return
+}
+
+// buildHermeticImage builds the image of each platform by one multi-stage
+// docker build with the source as build context, the app is compiled in the
+// builder stage instead of by BuildApp with host bind mounts, so it works
+// with remote docker hosts and docker in docker
+func (p *Builder) buildHermeticImage(platforms []Platform, dockerfileContent []byte) (err error) {
+	if p.Options.BuilderImage == "local" {
+		err = errors.New("hermetic build could not use local go build, a builder image is required")
+		return
+	}
+
+	if err = checkHermeticDockerfile(p.Options.DockerfileTmpl, dockerfileContent); err != nil {
+		return
+	}
+
+	var src hermeticSource
+	if src, err = p.hermeticSource(); err != nil {
+		return
+	}
+
+	var resPaths []string
+	if resPaths, err = p.resourcePaths(); err != nil {
+		return
+	}
+
+	ldflags := p.ldflags(p.Options.BuildTime)
+
+	// the build output and vcs are not a part of source
+	exclude := []string{".git"}
+	if outputRel, e := filepath.Rel(src.contextDir, p.outputDir()); e == nil && !strings.HasPrefix(outputRel, "..") {
+		exclude = append(exclude, filepath.ToSlash(outputRel))
+	}
+
+	targets := []*Platform{nil}
+	if len(platforms) > 0 {
+		targets = nil
+		for i := 0; i < len(platforms); i++ {
+			targets = append(targets, &platforms[i])
+		}
+	}
+
+	baseTagName := imageName(p.Options)
+
+	for i := 0; i < len(targets); i++ {
+		var stage []byte
+		if stage, err = p.builderStage(src, targets[i], ldflags, resPaths); err != nil {
+			return
+		}
+
+		content := append(stage, dockerfileContent...)
+
+		if p.dryRun() {
+			p.Plan.setDockerfile(targets[i], content)
+		}
+
+		options := ImageBuildOptions{
+			Dockerfile:        hermeticDockerfile,
+			DockerfileContent: content,
+			Labels:            p.imageLabels(),
+			Exclude:           exclude,
+		}
+
+		for j := 0; j < len(p.Options.AppImageTags); j++ {
+			options.Tags = append(options.Tags, fmt.Sprintf("%s:%s", baseTagName, platformTag(p.Options.AppImageTags[j], targets[i])))
+		}
+
+		if targets[i] != nil {
+			options.Platform = targets[i].String()
+		}
+
+		logger.Debugf("docker build %s from source %s, platform: %s", strings.Join(options.Tags, ", "), src.contextDir, options.Platform)
+
+		var imageID string
+		if imageID, err = p.Docker.BuildImage(src.contextDir, options); err != nil {
+			return
+		}
+
+		logger.Debugf("image built: %s", imageID)
+
+		if p.ImageIDs == nil {
+			p.ImageIDs = map[string]string{}
+		}
+
+		for j := 0; j < len(options.Tags); j++ {
+			p.ImageIDs[options.Tags[j]] = imageID
+		}
+	}
+
+	return
+}
@@ -0,0 +1,150 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckHermeticDockerfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "copy from builder",
+			content: "FROM alpine:latest\nCOPY --from=builder /go/app /go/app\n",
+		},
+		{
+			name:    "copy with flags",
+			content: "FROM alpine:latest\ncopy --chown=app:app --from=builder /go/app /go/app\n",
+		},
+		{
+			name:    "add source",
+			content: "FROM alpine:latest\nADD . /go/app\n",
+			wantErr: "has no COPY --from=builder",
+		},
+		{
+			name:    "copy from other stage",
+			content: "FROM alpine:latest\nCOPY --from=builder-cache /go/app /go/app\n",
+			wantErr: "has no COPY --from=builder",
+		},
+		{
+			name:    "commented copy",
+			content: "FROM alpine:latest\n# COPY --from=builder /go/app /go/app\nADD . /go/app\n",
+			wantErr: "has no COPY --from=builder",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			checkErr(t, checkHermeticDockerfile("Dockerfile.tmpl", []byte(test.content)), test.wantErr)
+		})
+	}
+}
+
+func TestHermeticBuildImage(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        []string
+		template     string
+		options      BuildOptions
+		wantPlatform string
+		wantStage    []string
+		wantErr      string
+	}{
+		{
+			name:    "module",
+			files:   []string{"go.mod", "main.go"},
+			options: BuildOptions{RegistryOrg: "gogap"},
+			wantStage: []string{
+				"FROM --platform=$BUILDPLATFORM golang:1.21-alpine AS builder\n",
+				"ENV GO111MODULE=on\n",
+				"COPY . /usr/src/myapp\n",
+			},
+		},
+		{
+			name:         "platform",
+			files:        []string{"go.mod", "main.go"},
+			options:      BuildOptions{RegistryOrg: "gogap", Platforms: []string{"linux/arm/v7"}},
+			wantPlatform: "linux/arm/v7",
+			wantStage: []string{
+				"FROM --platform=$BUILDPLATFORM golang:1.21-alpine AS builder\n",
+				"ENV GO111MODULE=on CGO_ENABLED=0 GOOS=linux GOARCH=arm GOARM=7\n",
+			},
+		},
+		{
+			name:     "template without copy from builder",
+			files:    []string{"go.mod", "main.go"},
+			template: "FROM {{.AppImage}}\nADD . /go/app\n",
+			options:  BuildOptions{RegistryOrg: "gogap"},
+			wantErr:  "has no COPY --from=builder",
+		},
+		{
+			name:    "local builder",
+			files:   []string{"go.mod", "main.go"},
+			options: BuildOptions{RegistryOrg: "gogap", BuilderImage: "local"},
+			wantErr: "a builder image is required",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			isolateEnv(t)
+
+			dir := t.TempDir()
+			writeFiles(t, dir, test.files...)
+
+			options := test.options
+			options.WorkDir = dir
+			options.BuildTime = testBuildTime
+			options.Hermetic = true
+
+			if len(test.template) > 0 {
+				options.DockerfileTmpl = filepath.Join(dir, "Dockerfile.tmpl")
+				if err := os.WriteFile(options.DockerfileTmpl, []byte(test.template), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			docker := &RecordingDocker{}
+			builder := &Builder{Options: options, Runner: noGitRunner(), Docker: docker}
+
+			err := builder.BuildImage()
+			if checkErr(t, err, test.wantErr) {
+				if len(docker.Builds) > 0 {
+					t.Errorf("image is built: %v", docker.CallLines())
+				}
+				return
+			}
+
+			if len(docker.Builds) != 1 {
+				t.Fatalf("docker calls = %q, want one build", docker.CallLines())
+			}
+
+			build := docker.Builds[0]
+			if build.Platform != test.wantPlatform {
+				t.Errorf("platform = %q, want %q", build.Platform, test.wantPlatform)
+			}
+
+			content := string(build.DockerfileContent)
+			if !strings.HasPrefix(content, test.wantStage[0]) {
+				t.Errorf("Dockerfile does not start with %q:\n%s", test.wantStage[0], content)
+			}
+
+			for j := 1; j < len(test.wantStage); j++ {
+				if !strings.Contains(content, test.wantStage[j]) {
+					t.Errorf("Dockerfile has no %q:\n%s", test.wantStage[j], content)
+				}
+			}
+
+			if !strings.Contains(content, "COPY --from=builder /go/app /go/app") {
+				t.Errorf("app is not copied from the builder stage:\n%s", content)
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package builder
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// BlobSource opens the blobs of images by digest
+type BlobSource interface {
+	Open(digest string) (io.ReadCloser, error)
+}
+
+// ImageArchive is an image saved by docker save, or an OCI image layout as
+// a dir or a tarball, it is a BlobSource of its images
+type ImageArchive struct {
+	Path string
+	// Manifests are the descriptors of top level manifests and indexes,
+	// annotated with their ref names
+	Manifests []Descriptor
+
+	isDir bool
+	// entries are the names of blobs in the tarball, keyed by digest
+	entries map[string]string
+	// blobs are the manifests generated for images of docker save
+	blobs map[string][]byte
+}
+
+// dockerArchiveImage is an item of manifest.json of docker save
+type dockerArchiveImage struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// OpenImageArchive opens an OCI image layout dir, or a tarball of an OCI
+// image layout or of docker save
+func OpenImageArchive(filename string) (archive *ImageArchive, err error) {
+	var fi os.FileInfo
+	if fi, err = os.Stat(filename); err != nil {
+		return
+	}
+
+	archive = &ImageArchive{
+		Path:    filename,
+		isDir:   fi.IsDir(),
+		entries: map[string]string{},
+		blobs:   map[string][]byte{},
+	}
+
+	if archive.isDir {
+		if _, err = os.Stat(filepath.Join(filename, ociLayoutFile)); err != nil {
+			err = fmt.Errorf("%s is not an OCI image layout: %s", filename, err)
+			return
+		}
+
+		var data []byte
+		if data, err = ioutil.ReadFile(filepath.Join(filename, ociIndexFile)); err != nil {
+			return
+		}
+
+		err = archive.loadIndex(data)
+		return
+	}
+
+	// index.json, oci-layout and manifest.json are small
+	files := map[string][]byte{}
+	if err = archive.walkTar(func(name string, hdr *tar.Header, r io.Reader) (bool, error) {
+		if name == ociIndexFile || name == ociLayoutFile || name == dockerArchiveManifestFilename {
+			data, e := ioutil.ReadAll(r)
+			files[name] = data
+			return false, e
+		}
+		return false, nil
+	}); err != nil {
+		return
+	}
+
+	if data, exist := files[ociIndexFile]; exist {
+		err = archive.loadIndex(data)
+		return
+	}
+
+	data, exist := files[dockerArchiveManifestFilename]
+	if !exist {
+		err = fmt.Errorf("%s is neither an OCI image layout nor a docker save archive", filename)
+		return
+	}
+
+	err = archive.loadDockerArchive(data)
+
+	return
+}
+
+func (p *ImageArchive) loadIndex(data []byte) (err error) {
+	var index Index
+	if err = json.Unmarshal(data, &index); err != nil {
+		err = fmt.Errorf("parse %s of %s failure: %s", ociIndexFile, p.Path, err)
+		return
+	}
+
+	for i := 0; i < len(index.Manifests); i++ {
+		if err = validateDigest(index.Manifests[i].Digest); err != nil {
+			return
+		}
+	}
+
+	p.Manifests = index.Manifests
+
+	return
+}
+
+// loadDockerArchive generates OCI manifests for the images of docker save,
+// the layers are pushed as they are, digests are computed by reading them
+func (p *ImageArchive) loadDockerArchive(data []byte) (err error) {
+	var images []dockerArchiveImage
+	if err = json.Unmarshal(data, &images); err != nil {
+		err = fmt.Errorf("parse %s of %s failure: %s", dockerArchiveManifestFilename, p.Path, err)
+		return
+	}
+
+	wanted := map[string]bool{}
+	for i := 0; i < len(images); i++ {
+		wanted[path.Clean(images[i].Config)] = true
+		for j := 0; j < len(images[i].Layers); j++ {
+			wanted[path.Clean(images[i].Layers[j])] = true
+		}
+	}
+
+	type entryInfo struct {
+		digest string
+		size   int64
+		gzip   bool
+	}
+
+	infos := map[string]entryInfo{}
+	if err = p.walkTar(func(name string, hdr *tar.Header, r io.Reader) (bool, error) {
+		if !wanted[name] {
+			return false, nil
+		}
+
+		br := bufio.NewReader(r)
+		magic, _ := br.Peek(2)
+
+		hash := sha256.New()
+		size, e := io.Copy(hash, br)
+		if e != nil {
+			return false, e
+		}
+
+		infos[name] = entryInfo{
+			digest: fmt.Sprintf("sha256:%x", hash.Sum(nil)),
+			size:   size,
+			gzip:   len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b,
+		}
+		p.entries[infos[name].digest] = name
+
+		return false, nil
+	}); err != nil {
+		return
+	}
+
+	for i := 0; i < len(images); i++ {
+		config, exist := infos[path.Clean(images[i].Config)]
+		if !exist {
+			err = fmt.Errorf("config %s of docker archive %s is not found", images[i].Config, p.Path)
+			return
+		}
+
+		manifest := Manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeOCIManifest,
+			Config:        Descriptor{MediaType: MediaTypeOCIConfig, Digest: config.digest, Size: config.size},
+		}
+
+		for j := 0; j < len(images[i].Layers); j++ {
+			layer, exist := infos[path.Clean(images[i].Layers[j])]
+			if !exist {
+				err = fmt.Errorf("layer %s of docker archive %s is not found", images[i].Layers[j], p.Path)
+				return
+			}
+
+			mediaType := MediaTypeOCILayer
+			if layer.gzip {
+				mediaType = MediaTypeOCILayerGzip
+			}
+
+			manifest.Layers = append(manifest.Layers, Descriptor{MediaType: mediaType, Digest: layer.digest, Size: layer.size})
+		}
+
+		var manifestData []byte
+		var desc Descriptor
+		if manifestData, desc, err = jsonDescriptor(MediaTypeOCIManifest, manifest); err != nil {
+			return
+		}
+
+		p.blobs[desc.Digest] = manifestData
+
+		if len(images[i].RepoTags) == 0 {
+			p.Manifests = append(p.Manifests, desc)
+			continue
+		}
+
+		// one descriptor for each tag, so that it could be selected by tag
+		for j := 0; j < len(images[i].RepoTags); j++ {
+			tagged := desc
+			tagged.Annotations = map[string]string{AnnotationRefName: images[i].RepoTags[j]}
+			p.Manifests = append(p.Manifests, tagged)
+		}
+	}
+
+	return
+}
+
+// Select returns the manifest of ref, ref could be the ref name annotation
+// such as v1, or a repo tag of docker save such as org/app:v1, ref could be
+// empty if the archive has only one image
+func (p *ImageArchive) Select(ref string) (desc Descriptor, err error) {
+
+	if len(ref) == 0 {
+		digests := map[string]bool{}
+		for i := 0; i < len(p.Manifests); i++ {
+			digests[p.Manifests[i].Digest] = true
+		}
+
+		if len(digests) != 1 {
+			err = fmt.Errorf("%s has %d images, the ref of image should be given", p.Path, len(digests))
+			return
+		}
+
+		desc = p.Manifests[0]
+		return
+	}
+
+	for i := 0; i < len(p.Manifests); i++ {
+		name := descriptorRefName(p.Manifests[i])
+		if name == ref || strings.HasSuffix(name, ":"+ref) || sameImageRef(name, ref) {
+			desc = p.Manifests[i]
+			return
+		}
+	}
+
+	// the ref name of an image without its full name is the tag only, it
+	// is the image if no other image has the same tag
+	_, _, tag, _ := parseImageReference(ref)
+
+	found := false
+	for i := 0; i < len(p.Manifests); i++ {
+		if p.Manifests[i].Annotations[AnnotationRefName] != tag {
+			continue
+		}
+
+		if found && p.Manifests[i].Digest != desc.Digest {
+			err = fmt.Errorf("image %s is ambiguous in %s, there are several images of tag %s", ref, p.Path, tag)
+			return
+		}
+
+		desc, found = p.Manifests[i], true
+	}
+
+	if !found {
+		err = fmt.Errorf("image %s is not found in %s", ref, p.Path)
+	}
+
+	return
+}
+
+// descriptorRefName is the image name of a manifest of index.json, the
+// containerd image name of docker 25+ is preferred to the ref name
+func descriptorRefName(desc Descriptor) string {
+	if name := desc.Annotations[AnnotationContainerdImageName]; len(name) > 0 {
+		return name
+	}
+
+	return desc.Annotations[AnnotationRefName]
+}
+
+// sameImageRef returns true if a and b are the same image, e.g: org/app:v1
+// and docker.io/org/app:v1
+func sameImageRef(a, b string) bool {
+	hostA, repoA, tagA, digestA := parseImageReference(a)
+	hostB, repoB, tagB, digestB := parseImageReference(b)
+
+	return registryHostname(hostA) == registryHostname(hostB) && repoA == repoB && tagA == tagB && digestA == digestB
+}
+
+// Open opens the blob of digest
+func (p *ImageArchive) Open(digest string) (rc io.ReadCloser, err error) {
+	if err = validateDigest(digest); err != nil {
+		return
+	}
+
+	if data, exist := p.blobs[digest]; exist {
+		rc = ioutil.NopCloser(strings.NewReader(string(data)))
+		return
+	}
+
+	name, exist := p.entries[digest]
+	if !exist {
+		name = path.Join("blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+	}
+
+	var f *os.File
+	if p.isDir {
+		if f, err = os.Open(filepath.Join(p.Path, filepath.FromSlash(name))); err != nil {
+			return
+		}
+		rc = f
+		return
+	}
+
+	if f, err = os.Open(p.Path); err != nil {
+		return
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		var hdr *tar.Header
+		if hdr, err = tr.Next(); err != nil {
+			f.Close()
+			if err == io.EOF {
+				err = fmt.Errorf("blob %s is not found in %s", digest, p.Path)
+			}
+			return
+		}
+
+		if path.Clean(strings.TrimPrefix(hdr.Name, "./")) == name {
+			rc = &tarEntryReader{Reader: tr, file: f}
+			return
+		}
+	}
+}
+
+// readBlob reads the whole blob, it is used for manifests and configs
+func readBlob(source BlobSource, digest string) (data []byte, err error) {
+	var rc io.ReadCloser
+	if rc, err = source.Open(digest); err != nil {
+		return
+	}
+	defer rc.Close()
+
+	if data, err = ioutil.ReadAll(rc); err != nil {
+		return
+	}
+
+	if digestOf(data) != digest {
+		err = fmt.Errorf("digest of blob %s mismatched", digest)
+	}
+
+	return
+}
+
+// walkTar calls fn with the regular files of the tarball, until fn returns
+// true or an error
+func (p *ImageArchive) walkTar(fn func(name string, hdr *tar.Header, r io.Reader) (bool, error)) (err error) {
+	var f *os.File
+	if f, err = os.Open(p.Path); err != nil {
+		return
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		var hdr *tar.Header
+		if hdr, err = tr.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		var stop bool
+		if stop, err = fn(path.Clean(strings.TrimPrefix(hdr.Name, "./")), hdr, tr); err != nil || stop {
+			return
+		}
+	}
+}
+
+// tarEntryReader reads an entry of a tarball and closes the file
+type tarEntryReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (p *tarEntryReader) Close() error {
+	return p.file.Close()
+}
@@ -0,0 +1,118 @@
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// build metadata which could be injected into package variables by -X ldflags
+const (
+	LDFlagsVersion   = "version"
+	LDFlagsBranch    = "branch"
+	LDFlagsRevision  = "revision"
+	LDFlagsBuildTime = "build-time"
+	LDFlagsTags      = "tags"
+	LDFlagsDirty     = "dirty"
+)
+
+var ldflagsKeys = []string{
+	LDFlagsVersion,
+	LDFlagsBranch,
+	LDFlagsRevision,
+	LDFlagsBuildTime,
+	LDFlagsTags,
+	LDFlagsDirty,
+}
+
+// ParseLDFlagsVars parses values in the format of <key>=<package.Var>,
+// e.g: version=main.Version, commit is accepted as an alias of revision
+func ParseLDFlagsVars(values ...string) (vars map[string]string, err error) {
+
+	for i := 0; i < len(values); i++ {
+		kv := strings.SplitN(values[i], "=", 2)
+		if len(kv) != 2 || len(kv[1]) == 0 || !strings.Contains(kv[1], ".") {
+			err = fmt.Errorf("bad ldflags var %q, it should be <key>=<package.Var>", values[i])
+			return
+		}
+
+		key := strings.TrimSpace(kv[0])
+		if key == "commit" {
+			key = LDFlagsRevision
+		}
+
+		if !isLDFlagsKey(key) {
+			err = fmt.Errorf("unknown ldflags var key %q, supported: %s", kv[0], strings.Join(ldflagsKeys, ", "))
+			return
+		}
+
+		if vars == nil {
+			vars = map[string]string{}
+		}
+
+		vars[key] = strings.TrimSpace(kv[1])
+	}
+
+	return
+}
+
+func isLDFlagsKey(key string) bool {
+	for i := 0; i < len(ldflagsKeys); i++ {
+		if ldflagsKeys[i] == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ldflagsValues returns the build metadata of the current revision,
+// version is the first image tag
+func (p *Builder) ldflagsValues(buildTime time.Time) map[string]string {
+	values := map[string]string{
+		LDFlagsBranch:    p.Options.RevisionBranch,
+		LDFlagsRevision:  p.Options.RevisionID,
+		LDFlagsBuildTime: buildTime.UTC().Format(time.RFC3339),
+		LDFlagsTags:      strings.Join(p.Options.AppImageTags, ","),
+		LDFlagsDirty:     strconv.FormatBool(p.Options.RevisionDirty),
+	}
+
+	if len(p.Options.AppImageTags) > 0 {
+		values[LDFlagsVersion] = p.Options.AppImageTags[0]
+	}
+
+	return values
+}
+
+// ldflags renders -X flags for the configured package variables
+func (p *Builder) ldflags(buildTime time.Time) string {
+	if len(p.Options.LDFlagsVars) == 0 {
+		return ""
+	}
+
+	values := p.ldflagsValues(buildTime)
+
+	var keys []string
+	for key := range p.Options.LDFlagsVars {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var flags []string
+	for i := 0; i < len(keys); i++ {
+		assignment := p.Options.LDFlagsVars[keys[i]] + "=" + values[keys[i]]
+		if strings.ContainsAny(assignment, " \t") {
+			// go splits ldflags by spaces, and keeps quoted fields as is
+			if strings.Contains(assignment, "'") {
+				assignment = "\"" + assignment + "\""
+			} else {
+				assignment = "'" + assignment + "'"
+			}
+		}
+		flags = append(flags, "-X", assignment)
+	}
+
+	return strings.Join(flags, " ")
+}
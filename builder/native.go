@@ -0,0 +1,266 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	nativeImageOCI     = "image.oci"
+	nativeImageArchive = "image.tar"
+	nativeImageTmp     = ".image.tmp"
+)
+
+// nativeExcludes are the files generated in build output dir, they are not
+// added into images
+var nativeExcludes = []string{".docker", "Dockerfile", artifactsFilename, nativeImageOCI, nativeImageArchive, nativeImageTmp}
+
+func validateEngine(engine, format string) (err error) {
+	switch engine {
+	case EngineDocker, EngineNative:
+	default:
+		return fmt.Errorf("unknown engine %q, it should be %s or %s", engine, EngineDocker, EngineNative)
+	}
+
+	switch format {
+	case ImageFormatOCI, ImageFormatDockerArchive:
+	default:
+		return fmt.Errorf("unknown image format %q, it should be %s or %s", format, ImageFormatOCI, ImageFormatDockerArchive)
+	}
+
+	return
+}
+
+// nativeImagePath is where EngineNative writes images, an OCI layout dir
+// or a docker-archive tarball in build output dir
+func (p *Builder) nativeImagePath() string {
+	if p.Options.ImageFormat == ImageFormatDockerArchive {
+		return filepath.Join(p.outputDir(), nativeImageArchive)
+	}
+	return filepath.Join(p.outputDir(), nativeImageOCI)
+}
+
+// buildNativeImage assembles the images of platforms without docker, all
+// tags are written into one OCI layout or docker-archive
+func (p *Builder) buildNativeImage(platforms []Platform) (err error) {
+	output := p.nativeImagePath()
+
+	// the binary of a build without --platform is of the builder image or
+	// the host, its arch is unknown here
+	if len(platforms) == 0 {
+		err = errors.New("the native engine needs the platform of app, please build app and image with --platform, e.g: --platform linux/amd64")
+		return
+	}
+
+	logger.Debugf("assemble image of %s on %s into %s", p.Options.BuildOutputDir, p.Options.AppImage, output)
+
+	baseTagName := imageName(p.Options)
+
+	if p.dryRun() {
+		for i := 0; i < len(platforms); i++ {
+			args := []string{"--base", p.Options.AppImage, "--platform", platforms[i].String(), "--format", p.Options.ImageFormat, "-o", output}
+			for j := 0; j < len(p.Options.AppImageTags); j++ {
+				args = append(args, "--tag", baseTagName+":"+p.Options.AppImageTags[j])
+			}
+
+			p.Plan.addNativeStep("assemble", append(args, filepath.Join(p.outputDir(), platforms[i].Dir()))...)
+		}
+		return
+	}
+
+	// the base image may be in the registry of app
+	if err = p.resolveRegistryAuth(os.Getenv); err != nil {
+		return
+	}
+
+	tmpDir := filepath.Join(p.outputDir(), nativeImageTmp)
+	os.RemoveAll(tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	var layout *ociLayoutWriter
+	if layout, err = newOCILayoutWriter(tmpDir); err != nil {
+		return
+	}
+
+	assembler := &ImageAssembler{
+		Base: p.Options.AppImage,
+		BaseAuth: RegistryAuth{
+			Username:      p.Options.RegistryUsername,
+			Password:      p.Options.RegistryPassword,
+			ServerAddress: p.Options.RegistryHost,
+			IdentityToken: p.Options.RegistryIdentityToken,
+		},
+		AppDir:       nativeAppDir,
+		Entrypoint:   []string{path.Join(nativeAppDir, p.Options.AppName)},
+		User:         p.Options.AppImageUser,
+		Labels:       p.imageLabels(),
+		ExposedPorts: p.Options.Exposes,
+		Annotations:  p.imageAnnotations(),
+		Created:      p.Options.BuildTime,
+		Exclude:      nativeExcludes,
+	}
+
+	if len(assembler.User) > 0 {
+		if uid, _ := numericUser(assembler.User); uid == 0 && !strings.HasPrefix(assembler.User, "0") {
+			logger.Warnf("app image user %s is not numeric, it should exist in %s", assembler.User, p.Options.AppImage)
+		}
+	}
+
+	var top Descriptor
+	var images []dockerArchiveImage
+
+	if len(platforms) == 1 {
+		// one platform is one image without a manifest list, so it could be
+		// a docker-archive too
+		contextDir := filepath.Join(p.outputDir(), platforms[0].Dir())
+
+		var manifest Manifest
+		if top, manifest, err = assembler.Assemble(layout, contextDir, platforms[0]); err != nil {
+			return
+		}
+
+		image := dockerArchiveImage{Config: blobArchivePath(manifest.Config.Digest)}
+		for i := 0; i < len(manifest.Layers); i++ {
+			image.Layers = append(image.Layers, blobArchivePath(manifest.Layers[i].Digest))
+		}
+		for i := 0; i < len(p.Options.AppImageTags); i++ {
+			image.RepoTags = append(image.RepoTags, baseTagName+":"+p.Options.AppImageTags[i])
+		}
+
+		images = append(images, image)
+	} else {
+		index := Index{SchemaVersion: 2, MediaType: MediaTypeOCIIndex, Annotations: assembler.Annotations}
+
+		for i := 0; i < len(platforms); i++ {
+			contextDir := filepath.Join(p.outputDir(), platforms[i].Dir())
+
+			var desc Descriptor
+			var manifest Manifest
+			if desc, manifest, err = assembler.Assemble(layout, contextDir, platforms[i]); err != nil {
+				return
+			}
+
+			index.Manifests = append(index.Manifests, desc)
+
+			image := dockerArchiveImage{Config: blobArchivePath(manifest.Config.Digest)}
+			for j := 0; j < len(manifest.Layers); j++ {
+				image.Layers = append(image.Layers, blobArchivePath(manifest.Layers[j].Digest))
+			}
+			for j := 0; j < len(p.Options.AppImageTags); j++ {
+				image.RepoTags = append(image.RepoTags, baseTagName+":"+platformTag(p.Options.AppImageTags[j], &platforms[i]))
+			}
+
+			images = append(images, image)
+		}
+
+		if top, err = layout.writeJSONBlob(MediaTypeOCIIndex, index); err != nil {
+			return
+		}
+	}
+
+	var refs []Descriptor
+	for i := 0; i < len(p.Options.AppImageTags); i++ {
+		ref := top
+		ref.Annotations = map[string]string{AnnotationRefName: baseTagName + ":" + p.Options.AppImageTags[i]}
+		refs = append(refs, ref)
+	}
+
+	if err = layout.writeIndex(refs); err != nil {
+		return
+	}
+
+	os.RemoveAll(output)
+
+	if p.Options.ImageFormat == ImageFormatDockerArchive {
+		if err = writeDockerArchive(tmpDir, output, images); err != nil {
+			return
+		}
+	} else if err = os.Rename(tmpDir, output); err != nil {
+		return
+	}
+
+	if p.ImageIDs == nil {
+		p.ImageIDs = map[string]string{}
+	}
+
+	for i := 0; i < len(p.Options.AppImageTags); i++ {
+		p.ImageIDs[baseTagName+":"+p.Options.AppImageTags[i]] = top.Digest
+	}
+
+	logger.Debugf("image assembled: %s", top.Digest)
+
+	return
+}
+
+// pushNativeImage pushes the images assembled by buildNativeImage to the
+// registry by the registry api
+func (p *Builder) pushNativeImage(auth RegistryAuth) (err error) {
+	output := p.nativeImagePath()
+	baseTagName := imageName(p.Options)
+	repo := strings.TrimPrefix(baseTagName, p.Options.RegistryHost+"/")
+
+	if p.dryRun() {
+		for i := 0; i < len(p.Options.AppImageTags); i++ {
+			p.Plan.addNativeStep("push", "--from", output, baseTagName+":"+p.Options.AppImageTags[i])
+		}
+		return
+	}
+
+	var archive *ImageArchive
+	if archive, err = OpenImageArchive(output); err != nil {
+		err = fmt.Errorf("open image of native engine failure, please build image first: %s", err)
+		return
+	}
+
+	var client *RegistryClient
+	if client, err = NewRegistryClient(p.Options.RegistryHost, auth); err != nil {
+		return
+	}
+
+	for i := 0; i < len(p.Options.AppImageTags); i++ {
+		var desc Descriptor
+		if desc, err = archive.Select(p.Options.AppImageTags[i]); err != nil {
+			if p.Options.ImageFormat == ImageFormatDockerArchive {
+				err = fmt.Errorf("%s, a docker-archive has no manifest list of platforms, use the oci image format", err)
+			}
+			return
+		}
+
+		// the annotation of tag is not a part of the image
+		desc.Annotations = nil
+
+		var digest string
+		if digest, err = client.PushImage(repo, p.Options.AppImageTags[i], desc, archive); err != nil {
+			return
+		}
+
+		ref := baseTagName + ":" + p.Options.AppImageTags[i]
+
+		logger.Debugf("image pushed: %s@%s", ref, digest)
+
+		if p.ImageDigests == nil {
+			p.ImageDigests = map[string]string{}
+		}
+		p.ImageDigests[ref] = digest
+	}
+
+	return
+}
+
+// clearNativeImage removes the images assembled by buildNativeImage
+func (p *Builder) clearNativeImage() (err error) {
+	output := p.nativeImagePath()
+
+	if p.dryRun() {
+		p.Plan.addCommand("rm", "-rf", output)
+		return
+	}
+
+	logger.Debugf("remove %s", output)
+
+	return os.RemoveAll(output)
+}
@@ -0,0 +1,94 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// media types of image manifests, configs and layers
+const (
+	MediaTypeOCIManifest          = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex             = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIConfig            = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer             = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGzip         = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeDockerManifest       = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerConfig         = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayerGzip      = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	AnnotationRefName             = "org.opencontainers.image.ref.name"
+	ociLayoutVersion              = "1.0.0"
+	ociLayoutFile                 = "oci-layout"
+	ociIndexFile                  = "index.json"
+	dockerArchiveManifestFilename = "manifest.json"
+)
+
+// AnnotationContainerdImageName is the full image name in index.json of
+// docker save of docker 25+, whose ref name annotation is the tag only
+const AnnotationContainerdImageName = "io.containerd.image.name"
+
+// Descriptor describes a blob or manifest by digest
+type Descriptor struct {
+	MediaType   string              `json:"mediaType"`
+	Digest      string              `json:"digest"`
+	Size        int64               `json:"size"`
+	Platform    *DescriptorPlatform `json:"platform,omitempty"`
+	Annotations map[string]string   `json:"annotations,omitempty"`
+}
+
+type DescriptorPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Manifest is an OCI image manifest, or a docker manifest v2 schema 2
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Index is an OCI image index, or a docker manifest list
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerManifestList
+}
+
+func isManifestMediaType(mediaType string) bool {
+	return mediaType == MediaTypeOCIManifest || mediaType == MediaTypeDockerManifest
+}
+
+func digestOf(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// jsonDescriptor marshals v and returns its data and descriptor
+func jsonDescriptor(mediaType string, v interface{}) (data []byte, desc Descriptor, err error) {
+	if data, err = json.Marshal(v); err != nil {
+		return
+	}
+
+	desc = Descriptor{MediaType: mediaType, Digest: digestOf(data), Size: int64(len(data))}
+
+	return
+}
+
+// validateDigest checks digest is sha256:<64 hex>, it is joined into paths
+func validateDigest(digest string) (err error) {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if len(hex) != 64 || hex == digest || strings.Trim(hex, "0123456789abcdef") != "" {
+		err = fmt.Errorf("invalid digest %q", digest)
+	}
+	return
+}
@@ -0,0 +1,231 @@
+package builder
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ociLayoutWriter writes blobs and the index of an OCI image layout dir
+type ociLayoutWriter struct {
+	dir string
+}
+
+func newOCILayoutWriter(dir string) (w *ociLayoutWriter, err error) {
+	if err = os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return
+	}
+
+	layout, _ := json.Marshal(map[string]string{"imageLayoutVersion": ociLayoutVersion})
+	if err = ioutil.WriteFile(filepath.Join(dir, ociLayoutFile), layout, 0644); err != nil {
+		return
+	}
+
+	w = &ociLayoutWriter{dir: dir}
+
+	return
+}
+
+func (p *ociLayoutWriter) blobPath(digest string) string {
+	return filepath.Join(p.dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (p *ociLayoutWriter) hasBlob(digest string) bool {
+	_, err := os.Stat(p.blobPath(digest))
+	return err == nil
+}
+
+// writeBlob writes data as a blob
+func (p *ociLayoutWriter) writeBlob(mediaType string, data []byte) (desc Descriptor, err error) {
+	desc = Descriptor{MediaType: mediaType, Digest: digestOf(data), Size: int64(len(data))}
+
+	if p.hasBlob(desc.Digest) {
+		return
+	}
+
+	err = ioutil.WriteFile(p.blobPath(desc.Digest), data, 0644)
+
+	return
+}
+
+// writeJSONBlob marshals v and writes it as a blob
+func (p *ociLayoutWriter) writeJSONBlob(mediaType string, v interface{}) (desc Descriptor, err error) {
+	var data []byte
+	if data, err = json.Marshal(v); err != nil {
+		return
+	}
+
+	return p.writeBlob(mediaType, data)
+}
+
+// blobWriter writes a blob whose digest is known after writing, it is
+// moved to its digest path by commit
+type blobWriter struct {
+	file   *os.File
+	hash   hash.Hash
+	size   int64
+	layout *ociLayoutWriter
+}
+
+func (p *ociLayoutWriter) newBlobWriter() (w *blobWriter, err error) {
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Join(p.dir, "blobs"), ".blob-"); err != nil {
+		return
+	}
+
+	w = &blobWriter{file: f, hash: sha256.New(), layout: p}
+
+	return
+}
+
+func (p *blobWriter) Write(b []byte) (n int, err error) {
+	if n, err = p.file.Write(b); err != nil {
+		return
+	}
+
+	p.hash.Write(b[:n])
+	p.size += int64(n)
+
+	return
+}
+
+func (p *blobWriter) commit(mediaType string) (desc Descriptor, err error) {
+	if err = p.file.Close(); err != nil {
+		os.Remove(p.file.Name())
+		return
+	}
+
+	desc = Descriptor{MediaType: mediaType, Digest: fmt.Sprintf("sha256:%x", p.hash.Sum(nil)), Size: p.size}
+
+	err = os.Rename(p.file.Name(), p.layout.blobPath(desc.Digest))
+
+	return
+}
+
+func (p *blobWriter) abort() {
+	p.file.Close()
+	os.Remove(p.file.Name())
+}
+
+// copyBlob copies the blob of desc from source, the digest is verified
+func (p *ociLayoutWriter) copyBlob(source BlobSource, desc Descriptor) (err error) {
+	if p.hasBlob(desc.Digest) {
+		return
+	}
+
+	var rc io.ReadCloser
+	if rc, err = source.Open(desc.Digest); err != nil {
+		return
+	}
+	defer rc.Close()
+
+	var w *blobWriter
+	if w, err = p.newBlobWriter(); err != nil {
+		return
+	}
+
+	if _, err = io.Copy(w, rc); err != nil {
+		w.abort()
+		return
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", w.hash.Sum(nil)); digest != desc.Digest {
+		w.abort()
+		err = fmt.Errorf("digest of blob %s mismatched, got %s", desc.Digest, digest)
+		return
+	}
+
+	_, err = w.commit(desc.MediaType)
+
+	return
+}
+
+// writeIndex writes index.json of the layout
+func (p *ociLayoutWriter) writeIndex(manifests []Descriptor) (err error) {
+	index := Index{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests:     manifests,
+	}
+
+	var data []byte
+	if data, err = json.MarshalIndent(index, "", "  "); err != nil {
+		return
+	}
+
+	return ioutil.WriteFile(filepath.Join(p.dir, ociIndexFile), data, 0644)
+}
+
+// writeDockerArchive writes the OCI layout dir as a tarball which docker
+// load accepts, with manifest.json of images
+func writeDockerArchive(layoutDir, filename string, images []dockerArchiveImage) (err error) {
+	var f *os.File
+	if f, err = os.Create(filename); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	tw := tar.NewWriter(f)
+
+	var manifest []byte
+	if manifest, err = json.Marshal(images); err != nil {
+		return
+	}
+
+	if err = tw.WriteHeader(&tar.Header{Name: dockerArchiveManifestFilename, Mode: 0644, Size: int64(len(manifest)), Typeflag: tar.TypeReg}); err != nil {
+		return
+	}
+
+	if _, err = tw.Write(manifest); err != nil {
+		return
+	}
+
+	err = filepath.Walk(layoutDir, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(layoutDir, filename)
+		if err != nil {
+			return err
+		}
+
+		if err = tw.WriteHeader(&tar.Header{Name: filepath.ToSlash(rel), Mode: 0644, Size: fi.Size(), Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+
+		blob, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+
+		_, err = io.Copy(tw, blob)
+
+		return err
+	})
+
+	if err != nil {
+		return
+	}
+
+	return tw.Close()
+}
+
+// blobArchivePath is the path of blob in the tarball of an OCI layout
+func blobArchivePath(digest string) string {
+	return path.Join("blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
@@ -0,0 +1,237 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Plan is what a dry run Builder would do, it is filled instead of
+// running any command, a Plan could be shared by several Builders
+type Plan struct {
+	RevisionBranch string   `json:"revision_branch"`
+	RevisionID     string   `json:"revision_id"`
+	Dirty          bool     `json:"dirty,omitempty"`
+	BranchPattern  string   `json:"branch_pattern,omitempty"`
+	Registry       string   `json:"registry"`
+	Organization   string   `json:"organization"`
+	AppName        string   `json:"app_name"`
+	Tags           []string `json:"tags"`
+	Images         []string `json:"images"`
+	// Dockerfiles are keyed by platform, the key is empty if no platform
+	Dockerfiles map[string]string `json:"dockerfiles,omitempty"`
+	Commands    []string          `json:"commands"`
+
+	locker sync.Mutex
+}
+
+func (p *Plan) addCommand(args ...string) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.Commands = append(p.Commands, shellJoin(args))
+}
+
+// addNativeStep adds a step of the native engine, which runs no command,
+// as native <step> <args>
+func (p *Plan) addNativeStep(step string, args ...string) {
+	p.addCommand(append([]string{"native", step}, args...)...)
+}
+
+// resolve merges the resolved options of a builder into the plan, empty
+// values are skipped and images are only taken from the builders of an
+// organization, e.g: the trigger builder of gtd all has no image options
+func (p *Plan) resolve(options BuildOptions) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if len(options.RevisionBranch) > 0 {
+		p.RevisionBranch = options.RevisionBranch
+	}
+
+	if len(options.RevisionID) > 0 {
+		p.RevisionID = options.RevisionID
+	}
+
+	if len(options.BranchPattern) > 0 {
+		p.BranchPattern = options.BranchPattern
+	}
+
+	if len(options.RegistryHost) > 0 {
+		p.Registry = options.RegistryHost
+	}
+
+	p.Dirty = p.Dirty || options.RevisionDirty
+
+	if len(options.RegistryOrg) == 0 && len(p.Images) > 0 {
+		return
+	}
+
+	if len(options.RegistryOrg) > 0 {
+		p.Organization = options.RegistryOrg
+	}
+
+	p.AppName = options.AppName
+	p.Tags = append([]string(nil), options.AppImageTags...)
+
+	p.Images = nil
+	for i := 0; i < len(options.AppImageTags); i++ {
+		p.Images = append(p.Images, imageName(options)+":"+options.AppImageTags[i])
+	}
+}
+
+// setDockerfile sets the Dockerfile of platform, platform is nil if the
+// image is not built by platforms
+func (p *Plan) setDockerfile(platform *Platform, content []byte) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.Dockerfiles == nil {
+		p.Dockerfiles = map[string]string{}
+	}
+
+	if platform == nil {
+		p.Dockerfiles[""] = string(content)
+	} else {
+		p.Dockerfiles[platform.String()] = string(content)
+	}
+}
+
+// Print writes the plan to w as text, or as JSON if asJSON is true
+func (p *Plan) Print(w io.Writer, asJSON bool) (err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(p)
+	}
+
+	buf := &strings.Builder{}
+
+	fmt.Fprintf(buf, "Revision branch: %s\n", p.RevisionBranch)
+	fmt.Fprintf(buf, "Revision id:     %s\n", p.RevisionID)
+	if p.Dirty {
+		fmt.Fprintln(buf, "Working tree:    dirty")
+	}
+	if len(p.BranchPattern) > 0 {
+		fmt.Fprintf(buf, "Branch config:   %s\n", p.BranchPattern)
+	}
+	fmt.Fprintf(buf, "Registry:        %s\n", p.Registry)
+	fmt.Fprintf(buf, "Organization:    %s\n", p.Organization)
+	fmt.Fprintf(buf, "App name:        %s\n", p.AppName)
+
+	fmt.Fprintln(buf, "Images:")
+	for i := 0; i < len(p.Images); i++ {
+		fmt.Fprintf(buf, "  %s\n", p.Images[i])
+	}
+
+	for _, platform := range sortedKeys(p.Dockerfiles) {
+		if len(platform) == 0 {
+			fmt.Fprintln(buf, "Dockerfile:")
+		} else {
+			fmt.Fprintf(buf, "Dockerfile of %s:\n", platform)
+		}
+		for _, line := range strings.Split(strings.TrimRight(p.Dockerfiles[platform], "\n"), "\n") {
+			fmt.Fprintf(buf, "  %s\n", line)
+		}
+	}
+
+	fmt.Fprintln(buf, "Commands:")
+	for i := 0; i < len(p.Commands); i++ {
+		fmt.Fprintf(buf, "  %s\n", p.Commands[i])
+	}
+
+	_, err = io.WriteString(w, buf.String())
+
+	return
+}
+
+// dryRunRunner runs the read only commands such as git rev-parse, and adds
+// the others to plan
+type dryRunRunner struct {
+	runner Runner
+	plan   *Plan
+}
+
+func (p *dryRunRunner) Run(cwd string, args ...string) error {
+	p.plan.addCommand(args...)
+	return nil
+}
+
+func (p *dryRunRunner) Output(cwd string, args ...string) ([]byte, error) {
+	return p.runner.Output(cwd, args...)
+}
+
+// dryRunDocker adds the docker cli equivalents of calls to plan
+type dryRunDocker struct {
+	plan *Plan
+}
+
+func (p *dryRunDocker) BuildImage(contextDir string, options ImageBuildOptions) (imageID string, err error) {
+	args := []string{"docker", "build"}
+
+	if len(options.Platform) > 0 {
+		args = append(args, "--platform", options.Platform)
+	}
+
+	for i := 0; i < len(options.Tags); i++ {
+		args = append(args, "-t", options.Tags[i])
+	}
+
+	for _, k := range sortedKeys(options.Labels) {
+		args = append(args, "--label", k+"="+options.Labels[k])
+	}
+
+	for _, k := range sortedKeys(options.BuildArgs) {
+		args = append(args, "--build-arg", k+"="+options.BuildArgs[k])
+	}
+
+	// the Dockerfile of plan is piped in
+	if len(options.DockerfileContent) > 0 {
+		args = append(args, "-f", "-")
+	} else if len(options.Dockerfile) > 0 {
+		args = append(args, "-f", options.Dockerfile)
+	}
+
+	p.plan.addCommand(append(args, contextDir)...)
+
+	return
+}
+
+func (p *dryRunDocker) TagImage(image, ref string) error {
+	p.plan.addCommand("docker", "tag", image, ref)
+	return nil
+}
+
+func (p *dryRunDocker) PushImage(ref string, auth RegistryAuth) (digest string, err error) {
+	p.plan.addCommand("docker", "push", ref)
+	return
+}
+
+func (p *dryRunDocker) RemoveImage(ref string, force bool) error {
+	if force {
+		p.plan.addCommand("docker", "rmi", "-f", ref)
+	} else {
+		p.plan.addCommand("docker", "rmi", ref)
+	}
+	return nil
+}
+
+func (p *dryRunDocker) SaveImage(refs []string, filename string) error {
+	p.plan.addCommand(append([]string{"docker", "save", "-o", filename}, refs...)...)
+	return nil
+}
+
+func (p *dryRunDocker) LoadImage(filename string) error {
+	p.plan.addCommand("docker", "load", "-i", filename)
+	return nil
+}
+
+func (p *dryRunDocker) RunContainer(config ContainerConfig) error {
+	p.plan.addCommand(config.Args()...)
+	return nil
+}
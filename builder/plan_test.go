@@ -0,0 +1,114 @@
+package builder
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestPlanOfAll runs the builders of gtd all against one plan, the builders
+// after BuildImage have less options and should not clear what is resolved
+func TestPlanOfAll(t *testing.T) {
+	isolateEnv(t)
+
+	dir := t.TempDir()
+	plan := &Plan{}
+
+	builders := []*Builder{
+		// build app
+		{Plan: plan, Runner: gitRunner("master", nil), Options: BuildOptions{WorkDir: dir, AppName: "server", BuildTime: testBuildTime}},
+		// build image
+		{Plan: plan, Runner: gitRunner("master", nil), Options: BuildOptions{WorkDir: dir, AppName: "server", RegistryHost: "reg.example.com", RegistryOrg: "myorg", BuildTime: testBuildTime}},
+		// push image
+		{Plan: plan, Runner: gitRunner("master", nil), Options: BuildOptions{WorkDir: dir, AppName: "server", RegistryHost: "reg.example.com", RegistryOrg: "myorg", BuildTime: testBuildTime}},
+		// push trigger
+		{Plan: plan, Runner: gitRunner("master", nil), Options: BuildOptions{WorkDir: dir, TriggerURIs: []string{"https://ci.example.com/hook"}, BuildTime: testBuildTime}},
+	}
+
+	steps := []func(*Builder) error{
+		(*Builder).BuildApp,
+		(*Builder).BuildImage,
+		(*Builder).PushImage,
+		(*Builder).PushTrigger,
+	}
+
+	for i := 0; i < len(steps); i++ {
+		if err := steps[i](builders[i]); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+
+	if plan.Registry != "reg.example.com" || plan.Organization != "myorg" || plan.AppName != "server" {
+		t.Errorf("registry, organization and app name = %q %q %q, want reg.example.com myorg server", plan.Registry, plan.Organization, plan.AppName)
+	}
+
+	if plan.RevisionBranch != "master" || plan.RevisionID != "01234567" {
+		t.Errorf("revision = %s %s, want master 01234567", plan.RevisionBranch, plan.RevisionID)
+	}
+
+	wantImages := []string{"reg.example.com/myorg/server:master", "reg.example.com/myorg/server:master-01234567"}
+	if !reflect.DeepEqual(plan.Images, wantImages) {
+		t.Errorf("images = %q, want %q", plan.Images, wantImages)
+	}
+
+	if len(plan.Dockerfiles[""]) == 0 {
+		t.Errorf("Dockerfile is not resolved: %q", plan.Dockerfiles)
+	}
+
+	if last := plan.Commands[len(plan.Commands)-1]; last != "curl -fsS https://ci.example.com/hook" {
+		t.Errorf("last command = %q, want the trigger", last)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := plan.Print(buf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"Registry:        reg.example.com", "Organization:    myorg", "  reg.example.com/myorg/server:master"} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("plan has no line %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestPlanOfHermeticPlatforms(t *testing.T) {
+	isolateEnv(t)
+
+	dir := t.TempDir()
+	writeFiles(t, dir, "go.mod", "main.go")
+
+	plan := &Plan{}
+	builder := &Builder{
+		Plan:   plan,
+		Runner: noGitRunner(),
+		Options: BuildOptions{
+			WorkDir:     dir,
+			RegistryOrg: "gogap",
+			Hermetic:    true,
+			Platforms:   []string{"linux/amd64", "linux/arm64"},
+			BuildTime:   testBuildTime,
+		},
+	}
+
+	if err := builder.BuildImage(); err != nil {
+		t.Fatal(err)
+	}
+
+	var platforms []string
+	for platform := range plan.Dockerfiles {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+
+	if want := []string{"linux/amd64", "linux/arm64"}; !reflect.DeepEqual(platforms, want) {
+		t.Fatalf("Dockerfiles of %q, want %q", platforms, want)
+	}
+
+	for i := 0; i < len(platforms); i++ {
+		if want := "GOARCH=" + strings.TrimPrefix(platforms[i], "linux/"); !strings.Contains(plan.Dockerfiles[platforms[i]], want) {
+			t.Errorf("Dockerfile of %s has no %s:\n%s", platforms[i], want, plan.Dockerfiles[platforms[i]])
+		}
+	}
+}
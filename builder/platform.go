@@ -0,0 +1,140 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	artifactsFilename = "artifacts.json"
+)
+
+// Platform is a build target in the format of <os>/<arch>[/<variant>]
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// Artifact is an app binary produced by BuildApp
+type Artifact struct {
+	Platform string `json:"platform,omitempty"`
+	Path     string `json:"path"`
+}
+
+// ParsePlatforms parses platforms like linux/amd64, each value could also
+// be a comma separated list
+func ParsePlatforms(values ...string) (platforms []Platform, err error) {
+
+	seen := map[string]bool{}
+
+	for i := 0; i < len(values); i++ {
+		for _, v := range strings.Split(values[i], ",") {
+			v = strings.TrimSpace(v)
+			if len(v) == 0 {
+				continue
+			}
+
+			var platform Platform
+			if platform, err = ParsePlatform(v); err != nil {
+				return
+			}
+
+			if seen[platform.String()] {
+				continue
+			}
+			seen[platform.String()] = true
+
+			platforms = append(platforms, platform)
+		}
+	}
+
+	return
+}
+
+func ParsePlatform(v string) (platform Platform, err error) {
+	parts := strings.Split(strings.ToLower(v), "/")
+	if len(parts) < 2 || len(parts) > 3 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		err = fmt.Errorf("bad platform %q, it should be <os>/<arch>[/<variant>]", v)
+		return
+	}
+
+	platform.OS = parts[0]
+	platform.Arch = parts[1]
+
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+
+	return
+}
+
+func (p Platform) String() string {
+	if len(p.Variant) > 0 {
+		return p.OS + "/" + p.Arch + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Arch
+}
+
+// Dir is the sub dir of build output for this platform, e.g. linux_amd64
+func (p Platform) Dir() string {
+	if len(p.Variant) > 0 {
+		return p.OS + "_" + p.Arch + "_" + p.Variant
+	}
+	return p.OS + "_" + p.Arch
+}
+
+// GoEnvs returns the go env vars for cross compiling to this platform
+func (p Platform) GoEnvs() []string {
+	envs := []string{"CGO_ENABLED=0", "GOOS=" + p.OS, "GOARCH=" + p.Arch}
+
+	switch {
+	case p.Arch == "arm" && len(p.Variant) > 0:
+		envs = append(envs, "GOARM="+strings.TrimPrefix(p.Variant, "v"))
+	case p.Arch == "amd64" && len(p.Variant) > 0:
+		envs = append(envs, "GOAMD64="+p.Variant)
+	}
+
+	return envs
+}
+
+func writeArtifacts(outputDir string, artifacts []Artifact) (err error) {
+	var data []byte
+	if data, err = json.MarshalIndent(artifacts, "", "  "); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(outputDir, 0755); err != nil {
+		return
+	}
+
+	return ioutil.WriteFile(filepath.Join(outputDir, artifactsFilename), data, 0644)
+}
+
+func readArtifacts(outputDir string) (artifacts []Artifact, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(filepath.Join(outputDir, artifactsFilename)); err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &artifacts)
+
+	return
+}
+
+// platformTag is the tag of the single platform image, which will be
+// referenced by the manifest list of tag, tag is truncated to leave room
+// for the platform suffix
+func platformTag(tag string, platform *Platform) string {
+	if platform == nil {
+		return tag
+	}
+
+	suffix := "-" + platform.Dir()
+
+	return truncateTagTo(tag, maxTagLength-len(suffix)) + suffix
+}
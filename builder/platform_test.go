@@ -0,0 +1,49 @@
+package builder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlatformTag(t *testing.T) {
+	long := strings.Repeat("a", maxTagLength)
+
+	tests := []struct {
+		name     string
+		tag      string
+		platform *Platform
+		want     string
+	}{
+		{
+			name: "no platform",
+			tag:  "v1",
+			want: "v1",
+		},
+		{
+			name:     "platform",
+			tag:      "v1",
+			platform: &Platform{OS: "linux", Arch: "arm", Variant: "v7"},
+			want:     "v1-linux_arm_v7",
+		},
+		{
+			name:     "long tag",
+			tag:      long,
+			platform: &Platform{OS: "linux", Arch: "arm64"},
+			want:     long[:maxTagLength-len("-linux_arm64")-9] + "-" + digestOf([]byte(long))[len("sha256:"):len("sha256:")+8] + "-linux_arm64",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			tag := platformTag(test.tag, test.platform)
+			if tag != test.want {
+				t.Errorf("platform tag = %q, want %q", tag, test.want)
+			}
+
+			if err := ValidateTag(tag); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// ProjectConfigFilenames are the project config files discovered in workdir, in order
+var ProjectConfigFilenames = []string{
+	".go-to-docker.yml",
+	".go-to-docker.yaml",
+	".go-to-docker.json",
+	".go-to-docker.toml",
+}
+
+// ProjectConfig is the build recipe of a repo, it could set every field of
+// BuildOptions, the values of flags and env vars take precedence over it
+type ProjectConfig struct {
+	AppName            string               `json:"name" yaml:"name" toml:"name"`
+	Verbose            bool                 `json:"verbose" yaml:"verbose" toml:"verbose"`
+	BuilderImage       string               `json:"builder_image" yaml:"builder_image" toml:"builder_image"`
+	BuilderImageUser   string               `json:"builder_image_user" yaml:"builder_image_user" toml:"builder_image_user"`
+	AppImage           string               `json:"app_image" yaml:"app_image" toml:"app_image"`
+	AppImageUser       string               `json:"app_image_user" yaml:"app_image_user" toml:"app_image_user"`
+	DockerfileTmpl     string               `json:"template" yaml:"template" toml:"template"`
+	BuildOutputDir     string               `json:"output" yaml:"output" toml:"output"`
+	Tags               []string             `json:"tags" yaml:"tags" toml:"tags"`
+	ReleaseLatest      bool                 `json:"release_latest" yaml:"release_latest" toml:"release_latest"`
+	Exposes            []string             `json:"expose" yaml:"expose" toml:"expose"`
+	Args               map[string]string    `json:"args" yaml:"args" toml:"args"`
+	Registry           string               `json:"registry" yaml:"registry" toml:"registry"`
+	Organization       string               `json:"organization" yaml:"organization" toml:"organization"`
+	Username           string               `json:"username" yaml:"username" toml:"username"`
+	Password           string               `json:"password" yaml:"password" toml:"password"`
+	TriggerURIs        []string             `json:"uri" yaml:"uri" toml:"uri"`
+	Resources          []string             `json:"res" yaml:"res" toml:"res"`
+	FakeBranch         string               `json:"fake_branch" yaml:"fake_branch" toml:"fake_branch"`
+	BranchTagsConfig   string               `json:"branch_tags_config" yaml:"branch_tags_config" toml:"branch_tags_config"`
+	Branchs            map[string]BranchTag `json:"branchs" yaml:"branchs" toml:"branchs"`
+	DockerInDockerUser string               `json:"dind_user" yaml:"dind_user" toml:"dind_user"`
+	GoPath             string               `json:"gopath" yaml:"gopath" toml:"gopath"`
+	ModCache           string               `json:"mod_cache" yaml:"mod_cache" toml:"mod_cache"`
+	Engine             string               `json:"engine" yaml:"engine" toml:"engine"`
+	ImageFormat        string               `json:"image_format" yaml:"image_format" toml:"image_format"`
+	Hermetic           bool                 `json:"hermetic" yaml:"hermetic" toml:"hermetic"`
+	Platforms          []string             `json:"platforms" yaml:"platforms" toml:"platforms"`
+	LDFlagsVars        map[string]string    `json:"ldflags_vars" yaml:"ldflags_vars" toml:"ldflags_vars"`
+	Labels             map[string]string    `json:"labels" yaml:"labels" toml:"labels"`
+}
+
+// FindProjectConfig returns the first project config file in dir, it
+// returns an empty filename if there is none
+func FindProjectConfig(dir string) (filename string, err error) {
+	for i := 0; i < len(ProjectConfigFilenames); i++ {
+		candidate := filepath.Join(dir, ProjectConfigFilenames[i])
+
+		var fi os.FileInfo
+		if fi, err = os.Stat(candidate); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			return
+		}
+
+		if !fi.IsDir() {
+			filename = candidate
+			return
+		}
+	}
+
+	return
+}
+
+// LoadProjectConfig reads the project config file, the format is decided by
+// the file extension: .yml, .yaml, .json or .toml
+func LoadProjectConfig(filename string) (config ProjectConfig, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &config)
+	case ".json":
+		err = json.Unmarshal(data, &config)
+	case ".toml":
+		err = toml.Unmarshal(data, &config)
+	default:
+		err = fmt.Errorf("unsupported project config format: %s", filename)
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("parse %s failure: %s", filename, err)
+		return
+	}
+
+	return
+}
+
+// LabelValues returns labels in the format of --label
+func (p ProjectConfig) LabelValues() []string {
+	var values []string
+	for _, key := range sortedKeys(p.Labels) {
+		values = append(values, key+"="+p.Labels[key])
+	}
+	return values
+}
+
+// LDFlagsVarValues returns ldflags_vars in the format of --ldflags-var
+func (p ProjectConfig) LDFlagsVarValues() []string {
+	var values []string
+	for _, key := range sortedKeys(p.LDFlagsVars) {
+		values = append(values, key+"="+p.LDFlagsVars[key])
+	}
+	return values
+}
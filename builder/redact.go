@@ -0,0 +1,106 @@
+package builder
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redacted = "******"
+
+// secretNameRegexp matches names of env vars, flags and url query params
+// whose values are credentials
+var secretNameRegexp = regexp.MustCompile(`(?i)(password|passwd|secret|token|auth|credential|api[_-]?key)`)
+
+// redactArgs returns a copy of args with credentials masked, such as the
+// value of --password, -p of docker login, PASSWORD=x env and user:pass@
+// or ?token=x of urls
+func redactArgs(args []string) []string {
+	masked := make([]string, len(args))
+
+	isLogin := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		masked[i] = arg
+
+		if arg == "login" {
+			isLogin = true
+		}
+
+		if i > 0 && isSecretFlag(args[i-1], isLogin) {
+			masked[i] = redacted
+			continue
+		}
+
+		if strings.HasPrefix(arg, "-") {
+			if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 && isSecretFlag(kv[0], isLogin) {
+				masked[i] = kv[0] + "=" + redacted
+			}
+			continue
+		}
+
+		if strings.Contains(arg, "://") {
+			masked[i] = redactURL(arg)
+			continue
+		}
+
+		// env vars such as REGISTRY_PASSWORD=x
+		if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 && isEnvName(kv[0]) && secretNameRegexp.MatchString(kv[0]) {
+			masked[i] = kv[0] + "=" + redacted
+		}
+	}
+
+	return masked
+}
+
+func isSecretFlag(flag string, isLogin bool) bool {
+	if !strings.HasPrefix(flag, "-") || strings.Contains(flag, "=") {
+		return false
+	}
+
+	// -p of docker run is the port
+	if flag == "-p" {
+		return isLogin
+	}
+
+	return strings.HasPrefix(flag, "--") && secretNameRegexp.MatchString(flag) && flag != "--password-stdin"
+}
+
+func isEnvName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return len(name) > 0
+}
+
+// redactURL masks the password of user info and credential query params
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+
+	query := u.Query()
+	changed := false
+	for key := range query {
+		if secretNameRegexp.MatchString(key) {
+			query.Set(key, redacted)
+			changed = true
+		}
+	}
+
+	if changed {
+		u.RawQuery = query.Encode()
+	}
+
+	s := u.String()
+	// keep the mask readable
+	return strings.Replace(s, url.QueryEscape(redacted), redacted, -1)
+}
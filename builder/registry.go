@@ -0,0 +1,669 @@
+package builder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultRegistryChunkSize = 5 << 20
+	dockerHubRegistry        = "https://registry-1.docker.io"
+)
+
+// RegistryClient pushes images to a registry by the registry http api v2,
+// without a docker daemon
+type RegistryClient struct {
+	// Auth is the credentials of registry, both token auth and basic auth
+	// are supported
+	Auth RegistryAuth
+	// ChunkSize is the size of blob upload chunks, 5MiB by default
+	ChunkSize int64
+	// MountFrom are the repositories of the same registry, their blobs are
+	// mounted instead of uploaded
+	MountFrom []string
+
+	base   *url.URL
+	client *http.Client
+
+	locker    sync.Mutex
+	challenge *authChallenge
+	tokens    map[string]string
+}
+
+// RegistryError is an error response of registry api
+type RegistryError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *RegistryError) Error() string {
+	if len(e.Code) > 0 {
+		return fmt.Sprintf("registry: %s: %s (status code: %d)", e.Code, e.Message, e.StatusCode)
+	}
+	return fmt.Sprintf("registry: %s (status code: %d)", e.Message, e.StatusCode)
+}
+
+// authChallenge is the WWW-Authenticate header of a 401 response
+type authChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// NewRegistryClient creates a client of server, such as registry.example.com,
+// localhost:5000 or http://127.0.0.1:5000, https is used unless the scheme
+// is given or the host is localhost, docker hub is used if server is empty
+func NewRegistryClient(server string, auth RegistryAuth) (c *RegistryClient, err error) {
+	switch {
+	case len(server) == 0 || registryHostname(server) == "index.docker.io":
+		server = dockerHubRegistry
+	case strings.Contains(server, "://"):
+	case strings.HasPrefix(server, "localhost") || strings.HasPrefix(server, "127.0.0.1"):
+		server = "http://" + server
+	default:
+		server = "https://" + server
+	}
+
+	var base *url.URL
+	if base, err = url.Parse(strings.TrimRight(server, "/")); err != nil {
+		return
+	}
+
+	c = &RegistryClient{
+		Auth:   auth,
+		base:   base,
+		client: &http.Client{},
+		tokens: map[string]string{},
+	}
+
+	return
+}
+
+// PushImage pushes the manifest or index of desc and all blobs it refers
+// to repo with tag, and returns the digest of the manifest
+func (p *RegistryClient) PushImage(repo, tag string, desc Descriptor, source BlobSource) (digest string, err error) {
+	return p.pushManifest(repo, tag, desc, source)
+}
+
+func (p *RegistryClient) pushManifest(repo, ref string, desc Descriptor, source BlobSource) (digest string, err error) {
+	var data []byte
+	if data, err = readBlob(source, desc.Digest); err != nil {
+		return
+	}
+
+	var header struct {
+		MediaType string `json:"mediaType"`
+	}
+
+	if err = json.Unmarshal(data, &header); err != nil {
+		err = fmt.Errorf("parse manifest %s failure: %s", desc.Digest, err)
+		return
+	}
+
+	mediaType := desc.MediaType
+	if len(mediaType) == 0 {
+		mediaType = header.MediaType
+	}
+
+	switch {
+	case isIndexMediaType(mediaType):
+		var index Index
+		if err = json.Unmarshal(data, &index); err != nil {
+			return
+		}
+
+		for i := 0; i < len(index.Manifests); i++ {
+			if _, err = p.pushManifest(repo, index.Manifests[i].Digest, index.Manifests[i], source); err != nil {
+				return
+			}
+		}
+	case isManifestMediaType(mediaType):
+		var manifest Manifest
+		if err = json.Unmarshal(data, &manifest); err != nil {
+			return
+		}
+
+		blobs := append([]Descriptor{manifest.Config}, manifest.Layers...)
+		for i := 0; i < len(blobs); i++ {
+			if err = p.PushBlob(repo, blobs[i], source); err != nil {
+				return
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported manifest media type %q of %s", mediaType, desc.Digest)
+		return
+	}
+
+	return p.PutManifest(repo, ref, mediaType, data)
+}
+
+// BlobExists checks whether the blob of digest is in repo
+func (p *RegistryClient) BlobExists(repo, digest string) (exist bool, err error) {
+	var resp *http.Response
+	if resp, err = p.do("HEAD", p.url("/v2/%s/blobs/%s", repo, digest), pushScopes(repo), nil, nil); err != nil {
+		if e, ok := err.(*RegistryError); ok && e.StatusCode == http.StatusNotFound {
+			err = nil
+		}
+		return
+	}
+	resp.Body.Close()
+
+	exist = true
+
+	return
+}
+
+// PushBlob uploads the blob of desc to repo if it is not there, the blob is
+// mounted from MountFrom repositories if possible
+func (p *RegistryClient) PushBlob(repo string, desc Descriptor, source BlobSource) (err error) {
+	if err = validateDigest(desc.Digest); err != nil {
+		return
+	}
+
+	var exist bool
+	if exist, err = p.BlobExists(repo, desc.Digest); err != nil || exist {
+		if exist {
+			logger.Debugf("blob %s exists in %s", desc.Digest, repo)
+		}
+		return
+	}
+
+	var location string
+	for i := 0; i < len(p.MountFrom) && len(location) == 0; i++ {
+		if p.MountFrom[i] == repo {
+			continue
+		}
+
+		var mounted bool
+		if mounted, location, err = p.mountBlob(repo, desc.Digest, p.MountFrom[i]); err != nil {
+			return
+		} else if mounted {
+			logger.Debugf("blob %s mounted from %s to %s", desc.Digest, p.MountFrom[i], repo)
+			return
+		}
+	}
+
+	if len(location) == 0 {
+		if location, err = p.startUpload(repo); err != nil {
+			return
+		}
+	}
+
+	if err = p.uploadBlob(repo, location, desc, source); err != nil {
+		return
+	}
+
+	logger.Debugf("blob %s uploaded to %s", desc.Digest, repo)
+
+	return
+}
+
+// mountBlob mounts the blob from another repository, if the registry could
+// not mount it, an upload is started and its location is returned
+func (p *RegistryClient) mountBlob(repo, digest, from string) (mounted bool, location string, err error) {
+	query := url.Values{"mount": {digest}, "from": {from}}
+
+	var resp *http.Response
+	if resp, err = p.do("POST", p.url("/v2/%s/blobs/uploads/", repo)+"?"+query.Encode(), append(pushScopes(repo), pullScope(from)), nil, nil); err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		mounted = true
+	case http.StatusAccepted:
+		location, err = p.location(resp)
+	default:
+		err = fmt.Errorf("unexpected status %d of mounting blob %s", resp.StatusCode, digest)
+	}
+
+	return
+}
+
+func (p *RegistryClient) startUpload(repo string) (location string, err error) {
+	var resp *http.Response
+	if resp, err = p.do("POST", p.url("/v2/%s/blobs/uploads/", repo), pushScopes(repo), nil, nil); err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		err = fmt.Errorf("unexpected status %d of starting blob upload", resp.StatusCode)
+		return
+	}
+
+	return p.location(resp)
+}
+
+// uploadBlob uploads the blob by chunks of PATCH, then completes it by PUT
+func (p *RegistryClient) uploadBlob(repo, location string, desc Descriptor, source BlobSource) (err error) {
+	var rc io.ReadCloser
+	if rc, err = source.Open(desc.Digest); err != nil {
+		return
+	}
+	defer rc.Close()
+
+	chunkSize := p.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultRegistryChunkSize
+	}
+
+	hash := sha256.New()
+	chunk := make([]byte, chunkSize)
+
+	var offset int64
+	for {
+		n, e := io.ReadFull(rc, chunk)
+		if e != nil && e != io.EOF && e != io.ErrUnexpectedEOF {
+			err = e
+			return
+		}
+
+		if n > 0 {
+			data := chunk[:n]
+			hash.Write(data)
+
+			headers := map[string]string{
+				"Content-Type":   "application/octet-stream",
+				"Content-Range":  fmt.Sprintf("%d-%d", offset, offset+int64(n)-1),
+				"Content-Length": strconv.Itoa(n),
+			}
+
+			var resp *http.Response
+			if resp, err = p.do("PATCH", location, pushScopes(repo), func() io.Reader { return bytes.NewReader(data) }, headers); err != nil {
+				return
+			}
+			resp.Body.Close()
+
+			if location, err = p.location(resp); err != nil {
+				return
+			}
+
+			offset += int64(n)
+		}
+
+		if e != nil {
+			break
+		}
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", hash.Sum(nil)); digest != desc.Digest || (desc.Size > 0 && offset != desc.Size) {
+		err = fmt.Errorf("blob %s mismatched, read %d bytes of digest %s", desc.Digest, offset, digest)
+		return
+	}
+
+	var u *url.URL
+	if u, err = url.Parse(location); err != nil {
+		return
+	}
+
+	query := u.Query()
+	query.Set("digest", desc.Digest)
+	u.RawQuery = query.Encode()
+
+	var resp *http.Response
+	if resp, err = p.do("PUT", u.String(), pushScopes(repo), nil, map[string]string{"Content-Length": "0"}); err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		err = fmt.Errorf("unexpected status %d of completing blob upload %s", resp.StatusCode, desc.Digest)
+	}
+
+	return
+}
+
+// PutManifest puts the manifest to repo with ref, a tag or digest, and
+// returns its digest
+func (p *RegistryClient) PutManifest(repo, ref, mediaType string, data []byte) (digest string, err error) {
+	headers := map[string]string{"Content-Type": mediaType}
+
+	var resp *http.Response
+	if resp, err = p.do("PUT", p.url("/v2/%s/manifests/%s", repo, ref), pushScopes(repo), func() io.Reader { return bytes.NewReader(data) }, headers); err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	digest = digestOf(data)
+
+	if d := resp.Header.Get("Docker-Content-Digest"); len(d) > 0 && d != digest {
+		logger.Warnf("registry digest %s of manifest %s:%s differs from %s", d, repo, ref, digest)
+	}
+
+	logger.Debugf("manifest pushed: %s:%s@%s", repo, ref, digest)
+
+	return
+}
+
+// GetManifest gets the manifest or index of ref, a tag or digest, in repo
+func (p *RegistryClient) GetManifest(repo, ref string) (data []byte, mediaType string, err error) {
+	headers := map[string]string{
+		"Accept": strings.Join([]string{MediaTypeOCIIndex, MediaTypeOCIManifest, MediaTypeDockerManifestList, MediaTypeDockerManifest}, ", "),
+	}
+
+	var resp *http.Response
+	if resp, err = p.do("GET", p.url("/v2/%s/manifests/%s", repo, ref), []string{pullScope(repo)}, nil, headers); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if data, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+
+	mediaType = resp.Header.Get("Content-Type")
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = strings.TrimSpace(mediaType[:i])
+	}
+
+	if strings.HasPrefix(ref, "sha256:") && digestOf(data) != ref {
+		err = fmt.Errorf("digest of manifest %s@%s mismatched", repo, ref)
+	}
+
+	return
+}
+
+// Blobs returns the BlobSource of repo, blobs are downloaded when opened
+func (p *RegistryClient) Blobs(repo string) BlobSource {
+	return &registryBlobSource{client: p, repo: repo}
+}
+
+type registryBlobSource struct {
+	client *RegistryClient
+	repo   string
+}
+
+func (p *registryBlobSource) Open(digest string) (rc io.ReadCloser, err error) {
+	if err = validateDigest(digest); err != nil {
+		return
+	}
+
+	var resp *http.Response
+	if resp, err = p.client.do("GET", p.client.url("/v2/%s/blobs/%s", p.repo, digest), []string{pullScope(p.repo)}, nil, nil); err != nil {
+		return
+	}
+
+	rc = resp.Body
+
+	return
+}
+
+func (p *RegistryClient) url(format string, args ...interface{}) string {
+	return p.base.String() + fmt.Sprintf(format, args...)
+}
+
+// location returns the absolute Location of resp
+func (p *RegistryClient) location(resp *http.Response) (location string, err error) {
+	var u *url.URL
+	if u, err = resp.Location(); err != nil {
+		err = fmt.Errorf("bad upload location of registry: %s", err)
+		return
+	}
+
+	location = u.String()
+
+	return
+}
+
+// do sends the request, when the registry responds 401 it authenticates by
+// the challenge and retries once, responses >= 400 are *RegistryError
+func (p *RegistryClient) do(method, rawurl string, scopes []string, body func() io.Reader, headers map[string]string) (resp *http.Response, err error) {
+	for retry := 0; ; retry++ {
+		var reader io.Reader
+		if body != nil {
+			reader = body()
+		}
+
+		var req *http.Request
+		if req, err = http.NewRequest(method, rawurl, reader); err != nil {
+			return
+		}
+
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		if cl, exist := headers["Content-Length"]; exist {
+			req.ContentLength, _ = strconv.ParseInt(cl, 10, 64)
+		}
+
+		var authorization string
+		if authorization, err = p.authorization(scopes); err != nil {
+			return
+		} else if len(authorization) > 0 {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		if resp, err = p.client.Do(req); err != nil {
+			return
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && retry == 0 {
+			challenge := parseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+			resp.Body.Close()
+
+			if challenge == nil {
+				err = &RegistryError{StatusCode: resp.StatusCode, Message: "unauthorized, no auth challenge"}
+				return
+			}
+
+			p.locker.Lock()
+			p.challenge = challenge
+			p.tokens = map[string]string{}
+			p.locker.Unlock()
+
+			continue
+		}
+
+		break
+	}
+
+	if resp.StatusCode >= 400 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		var message struct {
+			Errors []struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+
+		registryErr := &RegistryError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		if json.Unmarshal(data, &message) == nil && len(message.Errors) > 0 {
+			registryErr.Code = message.Errors[0].Code
+			registryErr.Message = message.Errors[0].Message
+		}
+
+		if len(registryErr.Message) == 0 {
+			registryErr.Message = http.StatusText(resp.StatusCode)
+		}
+
+		err = registryErr
+		resp = nil
+	}
+
+	return
+}
+
+// authorization returns the Authorization header of scopes by the last
+// challenge of registry
+func (p *RegistryClient) authorization(scopes []string) (authorization string, err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.challenge == nil {
+		return
+	}
+
+	switch strings.ToLower(p.challenge.Scheme) {
+	case "basic":
+		if len(p.Auth.Username) > 0 {
+			req := &http.Request{Header: http.Header{}}
+			req.SetBasicAuth(p.Auth.Username, p.Auth.Password)
+			authorization = req.Header.Get("Authorization")
+		}
+		return
+	case "bearer":
+	default:
+		err = fmt.Errorf("unsupported registry auth scheme %s", p.challenge.Scheme)
+		return
+	}
+
+	key := strings.Join(scopes, " ")
+
+	token, exist := p.tokens[key]
+	if !exist {
+		if token, err = p.fetchToken(scopes); err != nil {
+			return
+		}
+		p.tokens[key] = token
+	}
+
+	authorization = "Bearer " + token
+
+	return
+}
+
+// fetchToken gets a bearer token of scopes from the realm of challenge,
+// by basic auth of username and password, or by the identity token
+func (p *RegistryClient) fetchToken(scopes []string) (token string, err error) {
+	realm := p.challenge.Params["realm"]
+	if len(realm) == 0 {
+		err = fmt.Errorf("no realm in registry auth challenge")
+		return
+	}
+
+	query := url.Values{}
+	if service := p.challenge.Params["service"]; len(service) > 0 {
+		query.Set("service", service)
+	}
+
+	if len(scopes) == 0 && len(p.challenge.Params["scope"]) > 0 {
+		scopes = []string{p.challenge.Params["scope"]}
+	}
+
+	for i := 0; i < len(scopes); i++ {
+		query.Add("scope", scopes[i])
+	}
+
+	var req *http.Request
+	if len(p.Auth.IdentityToken) > 0 {
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", p.Auth.IdentityToken)
+		query.Set("client_id", "go-to-docker")
+
+		if req, err = http.NewRequest("POST", realm, strings.NewReader(query.Encode())); err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		if req, err = http.NewRequest("GET", realm+"?"+query.Encode(), nil); err != nil {
+			return
+		}
+
+		if len(p.Auth.Username) > 0 {
+			req.SetBasicAuth(p.Auth.Username, p.Auth.Password)
+		}
+	}
+
+	var resp *http.Response
+	if resp, err = p.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		err = &RegistryError{StatusCode: resp.StatusCode, Message: "get token failure: " + strings.TrimSpace(string(data))}
+		return
+	}
+
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+
+	token = result.Token
+	if len(token) == 0 {
+		token = result.AccessToken
+	}
+
+	if len(token) == 0 {
+		err = fmt.Errorf("no token in response of %s", realm)
+	}
+
+	return
+}
+
+// parseAuthChallenge parses header like: Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseAuthChallenge(header string) *authChallenge {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return nil
+	}
+
+	challenge := &authChallenge{Params: map[string]string{}}
+
+	i := strings.Index(header, " ")
+	if i < 0 {
+		challenge.Scheme = header
+		return challenge
+	}
+
+	challenge.Scheme = header[:i]
+	rest := header[i+1:]
+
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma+1:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		challenge.Params[key] = value
+	}
+
+	return challenge
+}
+
+func pushScopes(repo string) []string {
+	return []string{"repository:" + repo + ":pull,push"}
+}
+
+func pullScope(repo string) string {
+	return "repository:" + repo + ":pull"
+}
@@ -0,0 +1,398 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// memoryBlobs is a BlobSource of blobs keyed by digest
+type memoryBlobs map[string][]byte
+
+func (p memoryBlobs) Open(digest string) (io.ReadCloser, error) {
+	data, exist := p[digest]
+	if !exist {
+		return nil, fmt.Errorf("blob %s not found", digest)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// add adds data to blobs and returns its descriptor
+func (p memoryBlobs) add(mediaType string, data []byte) Descriptor {
+	p[digestOf(data)] = data
+	return Descriptor{MediaType: mediaType, Digest: digestOf(data), Size: int64(len(data))}
+}
+
+// addJSON adds v as a json blob and returns its descriptor
+func (p memoryBlobs) addJSON(t *testing.T, mediaType string, v interface{}) Descriptor {
+	data, desc, err := jsonDescriptor(mediaType, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p[desc.Digest] = data
+	return desc
+}
+
+// addImage adds the config, layers and manifest of an image of platform,
+// and returns the descriptor of the manifest
+func (p memoryBlobs) addImage(t *testing.T, platform string, layers ...string) Descriptor {
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        p.add(MediaTypeOCIConfig, []byte(`{"architecture":"`+platform+`"}`)),
+	}
+
+	for i := 0; i < len(layers); i++ {
+		manifest.Layers = append(manifest.Layers, p.add(MediaTypeOCILayer, []byte(layers[i])))
+	}
+
+	return p.addJSON(t, MediaTypeOCIManifest, manifest)
+}
+
+// newTestRegistry serves a MemoryRegistry, and returns a client of it
+func newTestRegistry(t *testing.T, registry *MemoryRegistry, auth RegistryAuth) *RegistryClient {
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+
+	client, err := NewRegistryClient(server.URL, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func countRequests(requests []string, request string) (n int) {
+	for i := 0; i < len(requests); i++ {
+		if requests[i] == request {
+			n++
+		}
+	}
+	return
+}
+
+func TestRegistryClientTokenAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    RegistryAuth
+		wantErr string
+	}{
+		{
+			name: "token",
+			auth: RegistryAuth{Username: "bob", Password: "secret"},
+		},
+		{
+			name:    "bad password",
+			auth:    RegistryAuth{Username: "bob", Password: "guess"},
+			wantErr: "get token failure",
+		},
+		{
+			name:    "anonymous",
+			wantErr: "get token failure",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			registry := &MemoryRegistry{Username: "bob", Password: "secret"}
+			client := newTestRegistry(t, registry, test.auth)
+
+			blobs := memoryBlobs{}
+			desc := blobs.add(MediaTypeOCILayer, []byte("layer"))
+
+			err := client.PushBlob("org/app", desc, blobs)
+
+			head := "HEAD /v2/org/app/blobs/" + desc.Digest
+			if len(registry.Requests) < 2 || !reflect.DeepEqual(registry.Requests[:2], []string{head, "GET /token"}) {
+				t.Fatalf("requests = %q, want a 401 of %s then GET /token", registry.Requests, head)
+			}
+
+			if checkErr(t, err, test.wantErr) {
+				return
+			}
+
+			// the request is retried with the token, and the token of the
+			// same scopes is reused
+			if registry.Requests[2] != head {
+				t.Errorf("request after the token = %q, want %q", registry.Requests[2], head)
+			}
+
+			if n := countRequests(registry.Requests, "GET /token"); n != 1 {
+				t.Errorf("token is requested %d times, want 1", n)
+			}
+
+			if _, exist := registry.Blob("org/app", desc.Digest); !exist {
+				t.Errorf("blob %s is not pushed", desc.Digest)
+			}
+
+			// pulling is another scope
+			if _, _, err = client.GetManifest("org/app", "latest"); !IsErrNotFound(err) {
+				t.Errorf("get manifest of nothing = %v, want not found", err)
+			}
+
+			if n := countRequests(registry.Requests, "GET /token"); n != 2 {
+				t.Errorf("token is requested %d times, want 2", n)
+			}
+		})
+	}
+}
+
+func TestRegistryClientPushBlob(t *testing.T) {
+	blob := []byte("0123456789abcdef01234")
+	digest := digestOf(blob)
+
+	tests := []struct {
+		name string
+		// pushed are the repositories which have the blob before the push
+		pushed    []string
+		mountFrom []string
+		// source is the content of the blob in the source, blob by default
+		source       []byte
+		digest       string
+		wantRequests []string
+		wantErr      string
+	}{
+		{
+			name: "chunked upload",
+			wantRequests: []string{
+				"HEAD /v2/org/app/blobs/" + digest,
+				"POST /v2/org/app/blobs/uploads/",
+				"PATCH /v2/org/app/blobs/uploads/1",
+				"PATCH /v2/org/app/blobs/uploads/1",
+				"PATCH /v2/org/app/blobs/uploads/1",
+				"PUT /v2/org/app/blobs/uploads/1",
+			},
+		},
+		{
+			name:         "existing blob",
+			pushed:       []string{"org/app"},
+			wantRequests: []string{"HEAD /v2/org/app/blobs/" + digest},
+		},
+		{
+			name:      "cross repository mount",
+			pushed:    []string{"org/base"},
+			mountFrom: []string{"org/app", "org/base"},
+			wantRequests: []string{
+				"HEAD /v2/org/app/blobs/" + digest,
+				"POST /v2/org/app/blobs/uploads/",
+			},
+		},
+		{
+			name:      "mount of unknown blob",
+			pushed:    []string{"org/other"},
+			mountFrom: []string{"org/base"},
+			wantRequests: []string{
+				"HEAD /v2/org/app/blobs/" + digest,
+				"POST /v2/org/app/blobs/uploads/",
+				"PATCH /v2/org/app/blobs/uploads/2",
+				"PATCH /v2/org/app/blobs/uploads/2",
+				"PATCH /v2/org/app/blobs/uploads/2",
+				"PUT /v2/org/app/blobs/uploads/2",
+			},
+		},
+		{
+			name:   "mismatched blob",
+			source: []byte("0123456789abcdef0123X"),
+			wantRequests: []string{
+				"HEAD /v2/org/app/blobs/" + digest,
+				"POST /v2/org/app/blobs/uploads/",
+				"PATCH /v2/org/app/blobs/uploads/1",
+				"PATCH /v2/org/app/blobs/uploads/1",
+				"PATCH /v2/org/app/blobs/uploads/1",
+			},
+			wantErr: "mismatched",
+		},
+		{
+			name:    "bad digest",
+			digest:  "sha256:../../manifests/latest",
+			wantErr: "invalid digest",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			registry := &MemoryRegistry{}
+			client := newTestRegistry(t, registry, RegistryAuth{})
+
+			for j := 0; j < len(test.pushed); j++ {
+				if err := client.PushBlob(test.pushed[j], Descriptor{Digest: digest, Size: int64(len(blob))}, memoryBlobs{digest: blob}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			registry.Requests = nil
+
+			client.ChunkSize = 8
+			client.MountFrom = test.mountFrom
+
+			source := test.source
+			if source == nil {
+				source = blob
+			}
+
+			desc := Descriptor{Digest: digest, Size: int64(len(blob))}
+			if len(test.digest) > 0 {
+				desc.Digest = test.digest
+			}
+
+			err := client.PushBlob("org/app", desc, memoryBlobs{desc.Digest: source})
+
+			if !reflect.DeepEqual(registry.Requests, test.wantRequests) {
+				t.Errorf("requests:\n%s\nwant:\n%s", strings.Join(registry.Requests, "\n"), strings.Join(test.wantRequests, "\n"))
+			}
+
+			if checkErr(t, err, test.wantErr) {
+				if _, exist := registry.Blob("org/app", digest); exist {
+					t.Errorf("blob %s is pushed", digest)
+				}
+				return
+			}
+
+			if data, exist := registry.Blob("org/app", digest); !exist || !bytes.Equal(data, blob) {
+				t.Errorf("blob = %q, %v, want %q", data, exist, blob)
+			}
+		})
+	}
+}
+
+func TestRegistryClientPushImage(t *testing.T) {
+	blobs := memoryBlobs{}
+
+	amd64 := blobs.addImage(t, "amd64", "base", "app-amd64")
+	arm64 := blobs.addImage(t, "arm64", "base", "app-arm64")
+
+	amd64.Platform = &DescriptorPlatform{OS: "linux", Architecture: "amd64"}
+	arm64.Platform = &DescriptorPlatform{OS: "linux", Architecture: "arm64"}
+
+	index := blobs.addJSON(t, MediaTypeOCIIndex, Index{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests:     []Descriptor{amd64, arm64},
+	})
+
+	missing := blobs.addJSON(t, MediaTypeOCIManifest, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        blobs.add(MediaTypeOCIConfig, []byte("{}")),
+		Layers:        []Descriptor{{MediaType: MediaTypeOCILayer, Digest: digestOf([]byte("missing")), Size: 7}},
+	})
+
+	tests := []struct {
+		name string
+		desc Descriptor
+		// wantManifests are the manifests put, in order
+		wantManifests []string
+		wantErr       string
+	}{
+		{
+			name:          "manifest",
+			desc:          amd64,
+			wantManifests: []string{"PUT /v2/org/app/manifests/v1"},
+		},
+		{
+			name: "index",
+			desc: index,
+			wantManifests: []string{
+				"PUT /v2/org/app/manifests/" + amd64.Digest,
+				"PUT /v2/org/app/manifests/" + arm64.Digest,
+				"PUT /v2/org/app/manifests/v1",
+			},
+		},
+		{
+			name:    "missing blob",
+			desc:    missing,
+			wantErr: "not found",
+		},
+		{
+			name:    "unsupported media type",
+			desc:    blobs.add(MediaTypeOCIConfig, []byte(`{"mediaType":"`+MediaTypeOCIConfig+`"}`)),
+			wantErr: "unsupported manifest media type",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			registry := &MemoryRegistry{Username: "bob", Password: "secret"}
+			client := newTestRegistry(t, registry, RegistryAuth{Username: "bob", Password: "secret"})
+
+			digest, err := client.PushImage("org/app", "v1", test.desc, blobs)
+
+			var puts []string
+			for j := 0; j < len(registry.Requests); j++ {
+				if strings.HasPrefix(registry.Requests[j], "PUT /v2/org/app/manifests/") {
+					puts = append(puts, registry.Requests[j])
+				}
+			}
+
+			if !reflect.DeepEqual(puts, test.wantManifests) {
+				t.Errorf("manifests put = %q, want %q", puts, test.wantManifests)
+			}
+
+			if checkErr(t, err, test.wantErr) {
+				return
+			}
+
+			if digest != test.desc.Digest {
+				t.Errorf("digest = %s, want %s", digest, test.desc.Digest)
+			}
+
+			for _, ref := range []string{"v1", digest} {
+				data, mediaType, err := client.GetManifest("org/app", ref)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(data, blobs[test.desc.Digest]) || mediaType != test.desc.MediaType {
+					t.Errorf("manifest of %s = %s %s, want %s %s", ref, mediaType, data, test.desc.MediaType, blobs[test.desc.Digest])
+				}
+			}
+		})
+	}
+}
+
+func TestRegistryClientManifestDigest(t *testing.T) {
+	registry := &MemoryRegistry{}
+	client := newTestRegistry(t, registry, RegistryAuth{})
+
+	blobs := memoryBlobs{}
+	desc := blobs.addImage(t, "amd64", "app")
+
+	if _, err := client.PushImage("org/app", "v1", desc, blobs); err != nil {
+		t.Fatal(err)
+	}
+
+	// a manifest put by the digest of other content is not trusted
+	other := digestOf([]byte("other"))
+	if _, err := client.PutManifest("org/app", other, desc.MediaType, blobs[desc.Digest]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.GetManifest("org/app", other); err == nil || !strings.Contains(err.Error(), "mismatched") {
+		t.Errorf("get manifest of mismatched digest = %v, want mismatched", err)
+	}
+
+	// the blobs of a manifest must be pushed before it
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{MediaType: MediaTypeOCIConfig, Digest: digestOf([]byte("config")), Size: 6},
+	}
+
+	data, unpushed, err := jsonDescriptor(MediaTypeOCIManifest, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.PutManifest("org/app", "v2", unpushed.MediaType, data)
+	if e, ok := err.(*RegistryError); !ok || e.Code != "MANIFEST_BLOB_UNKNOWN" {
+		t.Errorf("put manifest of unpushed blobs = %v, want MANIFEST_BLOB_UNKNOWN", err)
+	}
+}
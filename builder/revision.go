@@ -0,0 +1,211 @@
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Revision is the git revision of workdir
+type Revision struct {
+	Branch string
+	// SHA is the full commit id
+	SHA string
+	// NearestTag is the nearest git tag reachable from HEAD, empty if none
+	NearestTag string
+	// Tag is the git tag which HEAD is exactly at, it is the highest semver
+	// if there are several, empty if HEAD is not tagged
+	Tag string
+	// Dirty is true if tracked files have uncommitted changes
+	Dirty bool
+	// BuildNumber is the CI build number, empty if not built by CI
+	BuildNumber string
+	// Source is the url of git remote origin, empty if there is none
+	Source string
+}
+
+// ShortSHA is the first 8 chars of SHA
+func (p Revision) ShortSHA() string {
+	if len(p.SHA) > 8 {
+		return p.SHA[0:8]
+	}
+	return p.SHA
+}
+
+// getRevision returns the revision of dir, the branch, tag and commit of a
+// CI build are read from env by RevisionProviders, git gives the rest,
+// known is false if dir is neither a git repo nor built by CI
+func getRevision(runner Runner, dir string, getenv func(string) string) (revision Revision, known bool, err error) {
+	if revision, known, err = getGitRevision(runner, dir); err != nil {
+		return
+	}
+
+	ci, source, isCI := detectCIRevision(getenv)
+	if !isCI {
+		if known {
+			logger.Debugf("revision of branch %s is read from git", revision.Branch)
+		}
+		return
+	}
+
+	logger.Debugf("revision is read from %s, branch: %q, tag: %q, commit: %q", source, ci.Branch, ci.Tag, ci.SHA)
+
+	if len(ci.Tag) > 0 {
+		revision.Tag = ci.Tag
+		revision.NearestTag = ci.Tag
+		// the tag names a detached HEAD
+		revision.Branch = "HEAD"
+	}
+
+	if len(ci.Branch) > 0 {
+		revision.Branch = ci.Branch
+	}
+
+	if len(ci.SHA) > 0 {
+		revision.SHA = ci.SHA
+	}
+
+	if len(revision.Branch) == 0 {
+		revision.Branch = "HEAD"
+	}
+
+	revision.BuildNumber = ci.BuildNumber
+	known = true
+
+	return
+}
+
+func getGitRevision(runner Runner, dir string) (revision Revision, isGit bool, err error) {
+	cmdRevID := []string{"git", "rev-parse", "HEAD"}
+	cmdRevBranch := []string{"git", "rev-parse", "--abbrev-ref", "HEAD"}
+	cmdIsGit := []string{"git", "rev-parse", "--git-dir"}
+	cmdNearestTag := []string{"git", "describe", "--tags", "--abbrev=0"}
+	cmdHeadTags := []string{"git", "tag", "--points-at", "HEAD"}
+	// untracked files such as the build output are not counted as changes
+	cmdStatus := []string{"git", "status", "--porcelain", "--untracked-files=no"}
+	cmdRemoteURL := []string{"git", "config", "--get", "remote.origin.url"}
+	if _, e := runner.Output(dir, cmdIsGit...); e != nil {
+		return
+	}
+
+	var out1, out2 []byte
+	if out1, err = runner.Output(dir, cmdRevBranch...); err != nil {
+		if strings.Contains(string(out1), "HEAD") {
+			err = nil
+			out1 = []byte("master")
+		} else {
+			return
+		}
+	}
+
+	if out2, err = runner.Output(dir, cmdRevID...); err != nil {
+		if strings.Contains(string(out2), "HEAD") {
+			err = nil
+			out2 = []byte("0000000000000000000000000000000000000000")
+		} else {
+			return
+		}
+	}
+
+	// no tag is not an error
+	if out3, e := runner.Output(dir, cmdNearestTag...); e == nil {
+		revision.NearestTag = strings.TrimSpace(string(out3))
+	}
+
+	if out4, e := runner.Output(dir, cmdHeadTags...); e == nil {
+		revision.Tag = highestTag(strings.Fields(string(out4)))
+	}
+
+	var out5 []byte
+	if out5, err = runner.Output(dir, cmdStatus...); err != nil {
+		err = fmt.Errorf("get git status failure: %s, %s", err, strings.TrimSpace(string(out5)))
+		return
+	}
+
+	// no remote is not an error
+	if out6, e := runner.Output(dir, cmdRemoteURL...); e == nil {
+		revision.Source = sourceURL(strings.TrimSpace(string(out6)))
+	}
+
+	revision.Dirty = len(strings.TrimSpace(string(out5))) > 0
+	revision.Branch = strings.Trim(string(out1), "\n")
+	revision.SHA = strings.TrimSpace(string(out2))
+	isGit = true
+
+	return
+}
+
+func listGitTags(runner Runner, dir string) (tags []string, err error) {
+	var out []byte
+	if out, err = runner.Output(dir, "git", "tag", "--list"); err != nil {
+		err = fmt.Errorf("list git tags failure: %s, %s", err, strings.TrimSpace(string(out)))
+		return
+	}
+
+	tags = strings.Fields(string(out))
+
+	return
+}
+
+// highestTag returns the highest semver of tags, or the first one by name
+// if none is semver
+func highestTag(tags []string) (tag string) {
+	var highest Semver
+
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+
+	for i := 0; i < len(sorted); i++ {
+		if v, ok := ParseSemver(sorted[i]); ok && (!highest.Valid || v.Compare(highest) > 0) {
+			highest, tag = v, sorted[i]
+		}
+	}
+
+	if len(tag) == 0 && len(sorted) > 0 {
+		tag = sorted[0]
+	}
+
+	return
+}
+
+// releaseTags returns the image tags of a release at git tag, a stable
+// semver tag v1.4.2 gives 1.4.2, 1.4 and 1, plus latest if latest is true
+// and it is the highest stable version of allTags, other tags are sanitized
+func releaseTags(tag string, allTags []string, latest bool) (tags []string, err error) {
+	v, ok := ParseSemver(tag)
+	if !ok {
+		sanitized := SanitizeTag(tag)
+		if len(sanitized) == 0 {
+			err = fmt.Errorf("git tag %q has no chars of image tags [A-Za-z0-9_.-], set the image tags by --tag", tag)
+			return
+		}
+
+		tags = []string{sanitized}
+		return
+	}
+
+	if len(v.Prerelease) > 0 {
+		tags = []string{v.String()}
+		return
+	}
+
+	tags = []string{
+		v.String(),
+		fmt.Sprintf("%d.%d", v.Major, v.Minor),
+		fmt.Sprintf("%d", v.Major),
+	}
+
+	if !latest {
+		return
+	}
+
+	for i := 0; i < len(allTags); i++ {
+		if other, ok := ParseSemver(allTags[i]); ok && len(other.Prerelease) == 0 && other.Compare(v) > 0 {
+			return
+		}
+	}
+
+	tags = append(tags, "latest")
+
+	return
+}
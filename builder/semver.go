@@ -0,0 +1,76 @@
+package builder
+
+import (
+	"regexp"
+	"strconv"
+)
+
+var semverRegexp = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z.-]+))?(?:\+([0-9A-Za-z.-]+))?$`)
+
+// Semver is a semantic version such as v1.4.2 or 1.4.2-rc.1
+type Semver struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+	Build      string
+	// Valid is false if the version could not be parsed
+	Valid bool
+}
+
+func ParseSemver(v string) (semver Semver, ok bool) {
+	matches := semverRegexp.FindStringSubmatch(v)
+	if matches == nil {
+		return
+	}
+
+	semver.Major, _ = strconv.Atoi(matches[1])
+	semver.Minor, _ = strconv.Atoi(matches[2])
+	semver.Patch, _ = strconv.Atoi(matches[3])
+	semver.Prerelease = matches[4]
+	semver.Build = matches[5]
+	semver.Valid = true
+
+	return semver, true
+}
+
+func (p Semver) String() string {
+	if !p.Valid {
+		return ""
+	}
+
+	s := strconv.Itoa(p.Major) + "." + strconv.Itoa(p.Minor) + "." + strconv.Itoa(p.Patch)
+
+	if len(p.Prerelease) > 0 {
+		s += "-" + p.Prerelease
+	}
+
+	return s
+}
+
+// Compare returns -1, 0 or 1 if p is lower, equal or higher than o, a
+// prerelease is lower than its release, prereleases are compared by string
+func (p Semver) Compare(o Semver) int {
+	pairs := [][2]int{{p.Major, o.Major}, {p.Minor, o.Minor}, {p.Patch, o.Patch}}
+	for i := 0; i < len(pairs); i++ {
+		if pairs[i][0] != pairs[i][1] {
+			if pairs[i][0] < pairs[i][1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case p.Prerelease == o.Prerelease:
+		return 0
+	case len(p.Prerelease) == 0:
+		return 1
+	case len(o.Prerelease) == 0:
+		return -1
+	case p.Prerelease < o.Prerelease:
+		return -1
+	}
+
+	return 1
+}
@@ -0,0 +1,164 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// SourceDateEpochEnv pins the build time to a unix timestamp, e.g: the
+// commit time of HEAD, so separate commands render the same time tags
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+var (
+	processBuildTime     time.Time
+	processBuildTimeOnce sync.Once
+)
+
+// BuildTime returns the build time of the process, it is resolved once so
+// build app, build image and push image of one command render the same
+// {{.Timestamp}} tags, it is $SOURCE_DATE_EPOCH if set
+func BuildTime() time.Time {
+	processBuildTimeOnce.Do(func() {
+		processBuildTime = time.Now().UTC().Truncate(time.Second)
+
+		epoch := os.Getenv(SourceDateEpochEnv)
+		if len(epoch) == 0 {
+			return
+		}
+
+		if sec, err := strconv.ParseInt(epoch, 10, 64); err != nil {
+			logger.Warnf("bad %s %q, it should be a unix timestamp, the current time is used", SourceDateEpochEnv, epoch)
+		} else {
+			processBuildTime = time.Unix(sec, 0).UTC()
+		}
+	})
+
+	return processBuildTime
+}
+
+// DefaultTagTemplates are the image tags of a git repo without branch tags config
+var DefaultTagTemplates = []string{
+	"{{.Branch}}",
+	"{{.Branch}}-{{.ShortSHA}}",
+}
+
+// buildNumberEnvs are the env vars of CI build number, in order
+var buildNumberEnvs = []string{
+	"GTD_BUILD_NUMBER",
+	"GITHUB_RUN_NUMBER",
+	"CI_PIPELINE_IID",
+	"BUILD_NUMBER",
+	"DRONE_BUILD_NUMBER",
+}
+
+// TagContext is the data of image tag templates, e.g:
+// {{.Semver.Major}}.{{.Semver.Minor}} or {{.Branch}}-{{.ShortSHA}}
+type TagContext struct {
+	// Branch is the revision branch sanitized as a docker tag, e.g:
+	// feature/JIRA-12_new is feature-JIRA-12_new
+	Branch string
+	// RawBranch is the revision branch as is
+	RawBranch string
+	SHA       string
+	ShortSHA  string
+	// Dirty is true if the working tree has uncommitted changes
+	Dirty bool
+	// GitTag is the nearest git tag reachable from HEAD
+	GitTag string
+	// Tag is the git tag which HEAD is exactly at, empty if not a release
+	Tag string
+	// Semver is parsed from GitTag
+	Semver Semver
+	// Time is the UTC time of build
+	Time time.Time
+	// Date is Time in the format of 20060102
+	Date string
+	// Timestamp is Time in the format of 20060102150405
+	Timestamp   string
+	BuildNumber string
+	Env         map[string]string
+}
+
+func newTagContext(branch string, revision Revision, now time.Time) TagContext {
+	now = now.UTC()
+
+	ctx := TagContext{
+		Branch:    SanitizeTag(branch),
+		RawBranch: branch,
+		SHA:       revision.SHA,
+		ShortSHA:  revision.ShortSHA(),
+		Dirty:     revision.Dirty,
+		GitTag:    revision.NearestTag,
+		Tag:       revision.Tag,
+		Time:      now,
+		Date:      now.Format("20060102"),
+		Timestamp: now.Format("20060102150405"),
+		Env:       map[string]string{},
+	}
+
+	ctx.Semver, _ = ParseSemver(revision.NearestTag)
+
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			ctx.Env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	ctx.BuildNumber = revision.BuildNumber
+
+	for i := 0; i < len(buildNumberEnvs) && len(ctx.BuildNumber) == 0; i++ {
+		if v := ctx.Env[buildNumberEnvs[i]]; len(v) > 0 {
+			ctx.BuildNumber = v
+		}
+	}
+
+	return ctx
+}
+
+// renderTags evaluates the tag templates, empty and duplicated tags are dropped
+func renderTags(tmpls []string, ctx TagContext) (tags []string, err error) {
+	seen := map[string]bool{}
+
+	for i := 0; i < len(tmpls); i++ {
+		tag := tmpls[i]
+
+		if strings.Contains(tag, "{{") {
+			// a branch such as -.. sanitizes to nothing
+			if strings.Contains(tag, ".Branch") && len(ctx.Branch) == 0 && len(ctx.RawBranch) > 0 {
+				err = fmt.Errorf("branch %q has no chars of image tags [A-Za-z0-9_.-] for tag template %q, set --fake-branch or --tag", ctx.RawBranch, tmpls[i])
+				return
+			}
+
+			var tmpl *template.Template
+			if tmpl, err = template.New("tag").Option("missingkey=zero").Parse(tag); err != nil {
+				err = fmt.Errorf("bad tag template %q: %s", tmpls[i], err)
+				return
+			}
+
+			buf := bytes.NewBuffer(nil)
+			if err = tmpl.Execute(buf, ctx); err != nil {
+				err = fmt.Errorf("render tag template %q failure: %s", tmpls[i], err)
+				return
+			}
+
+			tag = buf.String()
+		}
+
+		tag = truncateTag(strings.TrimSpace(tag))
+
+		if len(tag) == 0 || seen[tag] {
+			continue
+		}
+
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	return
+}
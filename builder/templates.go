@@ -0,0 +1,299 @@
+package builder
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// TemplatePrefix prefixes the names of embedded Dockerfile templates,
+	// such as name:scratch, other templates are file paths
+	TemplatePrefix = "name:"
+	// DefaultTemplate is the template from the app image, alpine:latest by
+	// default
+	DefaultTemplate = TemplatePrefix + "default"
+)
+
+//go:embed dockerfiles_tmpl
+var embeddedTemplates embed.FS
+
+// TemplateNames returns the names of embedded Dockerfile templates
+func TemplateNames() []string {
+	names := []string{}
+
+	entries, _ := embeddedTemplates.ReadDir("dockerfiles_tmpl")
+	for i := 0; i < len(entries); i++ {
+		names = append(names, entries[i].Name())
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// readDockerfileTemplate reads the embedded template of name:<x>, or the
+// template file
+func readDockerfileTemplate(tmpl string) (data []byte, err error) {
+	if !strings.HasPrefix(tmpl, TemplatePrefix) {
+		return ioutil.ReadFile(tmpl)
+	}
+
+	name := strings.TrimPrefix(tmpl, TemplatePrefix)
+
+	if data, err = embeddedTemplates.ReadFile(path.Join("dockerfiles_tmpl", name)); err != nil {
+		err = fmt.Errorf("unknown Dockerfile template %s, the embedded templates are: %s", tmpl, strings.Join(TemplateNames(), ", "))
+		return
+	}
+
+	return
+}
+
+// TemplateContext is what Dockerfile templates are rendered with, it has
+// no credentials of options, since the rendered Dockerfile is printed by dry
+// runs and render dockerfile
+type TemplateContext struct {
+	// AppName, AppImage, AppImageUser, AppArgs, Exposes and Hermetic are the
+	// options of the same names, as templates before TemplateContext use them
+	AppName      string
+	AppImage     string
+	AppImageUser string
+	AppArgs      map[string]string
+	Exposes      []string
+	Hermetic     bool
+
+	// App is the app name, the binary is /go/app/{{.App}}
+	App string
+	// Image is the base image of app, --app-image
+	Image string
+	// User is the app image user, --app-image-user
+	User string
+	// Revision is the short git revision, Branch is the revision branch
+	Revision string
+	Branch   string
+	Dirty    bool
+	// Tag is the git tag which HEAD is exactly at, empty if not a release,
+	// Semver is parsed from it
+	Tag    string
+	Semver Semver
+	// Tags are the image tags, Images are the full image refs of them
+	Tags   []string
+	Images []string
+	// Resources are the paths of resources relative to workdir, their
+	// globs are expanded
+	Resources []string
+	// Args are the args of --args
+	Args map[string]string
+	// Labels are the labels of the image, the OCI labels, revision labels
+	// and --label
+	Labels map[string]string
+	// Ports are the exposed ports, --expose
+	Ports []string
+}
+
+func (p *Builder) templateContext() (ctx TemplateContext, err error) {
+	ctx = TemplateContext{
+		AppName:      p.Options.AppName,
+		AppImage:     p.Options.AppImage,
+		AppImageUser: p.Options.AppImageUser,
+		AppArgs:      p.Options.AppArgs,
+		Exposes:      p.Options.Exposes,
+		Hermetic:     p.Options.Hermetic,
+		App:          p.Options.AppName,
+		Image:        p.Options.AppImage,
+		User:         p.Options.AppImageUser,
+		Revision:     p.Options.RevisionID,
+		Branch:       p.Options.RevisionBranch,
+		Dirty:        p.Options.RevisionDirty,
+		Tag:          p.Options.RevisionTag,
+		Tags:         p.Options.AppImageTags,
+		Args:         p.Options.AppArgs,
+		Labels:       p.imageLabels(),
+		Ports:        p.Options.Exposes,
+	}
+
+	ctx.Semver, _ = ParseSemver(p.Options.RevisionTag)
+
+	baseTagName := imageName(p.Options)
+	for i := 0; i < len(p.Options.AppImageTags); i++ {
+		ctx.Images = append(ctx.Images, baseTagName+":"+p.Options.AppImageTags[i])
+	}
+
+	if ctx.Resources, err = p.resourcePaths(); err != nil {
+		return
+	}
+
+	return
+}
+
+// templateFuncs are the functions of Dockerfile templates
+var templateFuncs = template.FuncMap{
+	// default "alpine" .Args.base gives alpine if .Args.base is empty
+	"default": func(def, value interface{}) interface{} {
+		if isEmptyValue(value) {
+			return def
+		}
+		return value
+	},
+	"env":   os.Getenv,
+	"upper": strings.ToUpper,
+	// join " " .Ports, or .Ports | join " "
+	"join": func(sep string, values interface{}) string {
+		return strings.Join(toStrings(values), sep)
+	},
+	"toJson": func(v interface{}) (string, error) {
+		data, err := dockerfileJSONValue(v)
+		return string(data), err
+	},
+	"quote": func(v interface{}) string {
+		return strconv.Quote(fmt.Sprint(v))
+	},
+	// indent 4 .Args.script indents each line by 4 spaces
+	"indent": func(spaces int, s string) string {
+		pad := strings.Repeat(" ", spaces)
+		return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+	},
+}
+
+func isEmptyValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+
+	return false
+}
+
+func toStrings(values interface{}) []string {
+	if strs, ok := values.([]string); ok {
+		return strs
+	}
+
+	var strs []string
+
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return []string{fmt.Sprint(values)}
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		strs = append(strs, fmt.Sprint(v.Index(i).Interface()))
+	}
+
+	return strs
+}
+
+// renderDockerfile renders the Dockerfile template with TemplateContext
+func (p *Builder) renderDockerfile() (content []byte, err error) {
+	logger.Debugf("using Dockerfile template of %s", p.Options.DockerfileTmpl)
+
+	var tmplbuf []byte
+	if tmplbuf, err = readDockerfileTemplate(p.Options.DockerfileTmpl); err != nil {
+		return
+	}
+
+	var tmpl *template.Template
+	if tmpl, err = template.New(p.Options.DockerfileTmpl).Funcs(templateFuncs).Parse(string(tmplbuf)); err != nil {
+		return
+	}
+
+	var ctx TemplateContext
+	if ctx, err = p.templateContext(); err != nil {
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = tmpl.Execute(buf, ctx); err != nil {
+		return
+	}
+
+	content = buf.Bytes()
+
+	return
+}
+
+// RenderDockerfile writes the Dockerfile BuildImage would build with to w,
+// with the builder stage of the first platform for hermetic builds
+func (p *Builder) RenderDockerfile(w io.Writer) (err error) {
+	if err = p.initOptions(); err != nil {
+		return
+	}
+
+	cwd, _ := os.Getwd()
+	if cwd != p.Options.WorkDir {
+		os.Chdir(p.Options.WorkDir)
+	}
+
+	defer func() {
+		if cwd != p.Options.WorkDir {
+			os.Chdir(cwd)
+		}
+	}()
+
+	var content []byte
+	if content, err = p.renderDockerfile(); err != nil {
+		return
+	}
+
+	if p.Options.Hermetic {
+		// the Dockerfile is still printed, to show what is wrong
+		if e := checkHermeticDockerfile(p.Options.DockerfileTmpl, content); e != nil {
+			logger.Warnln(e)
+		}
+
+		var platforms []Platform
+		if platforms, err = p.targetPlatforms(); err != nil {
+			return
+		}
+
+		var platform *Platform
+		if len(platforms) > 0 {
+			platform = &platforms[0]
+		}
+
+		var src hermeticSource
+		if src, err = p.hermeticSource(); err != nil {
+			return
+		}
+
+		var resPaths []string
+		if resPaths, err = p.resourcePaths(); err != nil {
+			return
+		}
+
+		var stage []byte
+		if stage, err = p.builderStage(src, platform, p.ldflags(p.Options.BuildTime), resPaths); err != nil {
+			return
+		}
+
+		content = append(stage, content...)
+	}
+
+	_, err = w.Write(content)
+
+	return
+}
@@ -3,7 +3,8 @@ package builder
 import (
 	"io"
 	"os"
-	"strings"
+	"path/filepath"
+	"sort"
 )
 
 func copyfile(src, dst string) (err error) {
@@ -33,36 +34,27 @@ func copyfile(src, dst string) (err error) {
 	return
 }
 
-func getRevision(dir string) (branchName, revisionID string, isGit bool, err error) {
-	cmdRevID := `git rev-parse HEAD`
-	cmdRevBranch := `git rev-parse --abbrev-ref HEAD`
-	cmdIsGit := `git rev-parse --git-dir`
-	if _, e := execCommand(dir, cmdIsGit); e != nil {
-		return
-	}
-
-	var out1, out2 []byte
-	if out1, err = execCommand(dir, cmdRevBranch); err != nil {
-		if strings.Contains(string(out1), "HEAD") {
-			err = nil
-			out1 = []byte("master")
-		} else {
-			return
+// findModuleRoot walks up from dir looking for a go.mod file
+func findModuleRoot(dir string) (root string, found bool) {
+	dir = filepath.Clean(dir)
+	for {
+		if fi, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !fi.IsDir() {
+			return dir, true
 		}
-	}
 
-	if out2, err = execCommand(dir, cmdRevID); err != nil {
-		if strings.Contains(string(out2), "HEAD") {
-			err = nil
-			out2 = []byte("0000000000000000000000000000000000000000")
-		} else {
-			return
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
 		}
+		dir = parent
 	}
+}
 
-	branchName = strings.Trim(string(out1), "\n")
-	revisionID = string(out2[0:8])
-	isGit = true
-
-	return
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
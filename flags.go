@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"strings"
 
+	"github.com/gogap/go-to-docker/builder"
 	"github.com/urfave/cli"
 )
 
@@ -21,9 +22,9 @@ var (
 
 	BuilderImageFlag = cli.StringFlag{
 		Name:   "builder-image, bi",
-		Value:  "golang:1.8-alpine",
+		Value:  builder.DefaultBuilderImage,
 		EnvVar: "GTD_BUILDER_IMAGE",
-		Usage:  "Builder image",
+		Usage:  "Builder image, a go image with go modules support (go 1.11+)",
 	}
 
 	BuilderImageUserFlag = cli.StringFlag{
@@ -32,6 +33,18 @@ var (
 		Usage:  "Builder image user (format: <name|uid>[:<group|gid>])",
 	}
 
+	PlatformFlag = cli.StringSliceFlag{
+		Name:   "platform",
+		EnvVar: "GTD_PLATFORM",
+		Usage:  "Target platforms, e.g: linux/amd64,linux/arm64, one app and image will be built for each",
+	}
+
+	LDFlagsVarFlag = cli.StringSliceFlag{
+		Name:   "ldflags-var",
+		EnvVar: "GTD_LDFLAGS_VAR",
+		Usage:  "Inject build metadata into package variable by -X ldflags (format: <version|branch|revision|build-time|tags>=<package.Var>), e.g: version=main.Version",
+	}
+
 	ResFlag = cli.StringSliceFlag{
 		Name:  "res",
 		Usage: "App related resources, app will depends on these files, e.g: *.conf",
@@ -56,9 +69,28 @@ var (
 		Usage: "Build image with these tags",
 	}
 
-	ExposeFlag = cli.StringFlag{
-		Name:  "args, a",
-		Usage: "Args for render Dockerfile template, it should be JSON format",
+	ReleaseLatestFlag = cli.BoolFlag{
+		Name:   "release-latest",
+		EnvVar: "GTD_RELEASE_LATEST",
+		Usage:  "Also tag latest when HEAD is at the highest stable semver git tag",
+	}
+
+	ArgsFlag = cli.StringFlag{
+		Name:   "args, a",
+		EnvVar: "GTD_ARGS",
+		Usage:  "Args for render Dockerfile template as {{.AppArgs.key}}, it should be JSON format, e.g: {\"key\":\"value\"}",
+	}
+
+	ExposeFlag = cli.StringSliceFlag{
+		Name:   "expose, e",
+		EnvVar: "GTD_EXPOSE",
+		Usage:  "Ports exposed by app image (format: <port>[/<tcp|udp|sctp>]), e.g: 8080, 53/udp",
+	}
+
+	LabelFlag = cli.StringSliceFlag{
+		Name:   "label, l",
+		EnvVar: "GTD_LABEL",
+		Usage:  "Labels of app image besides the org.opencontainers.image.* labels (format: <key>=<value>), e.g: maintainer=ops",
 	}
 
 	AppImageUserFlag = cli.StringFlag{
@@ -76,8 +108,8 @@ var (
 
 	TemplateFlag = cli.StringFlag{
 		Name:  "template",
-		Value: fmt.Sprintf("%s/src/%s", os.Getenv("GOPATH"), "github.com/gogap/go-to-docker/builder/dockerfiles_tmpl/default"),
-		Usage: "Build app docker image by this Dockerfile template",
+		Value: builder.DefaultTemplate,
+		Usage: fmt.Sprintf("Build app docker image by this Dockerfile template file, or an embedded template name:<%s>", strings.Join(builder.TemplateNames(), "|")),
 	}
 
 	URIFlag = cli.StringSliceFlag{
@@ -96,6 +128,25 @@ var (
 		Usage:  "Docker in docker user (format: <name|uid>[:<group|gid>])",
 	}
 
+	ConfigFlag = cli.StringFlag{
+		Name:   "config",
+		EnvVar: "GTD_CONFIG",
+		Usage:  "Project config file (.yml, .yaml, .json or .toml), default is .go-to-docker.yml|.yaml|.json|.toml in workdir",
+	}
+
+	DryRunFlag = cli.BoolFlag{
+		Name:   "dry-run",
+		EnvVar: "GTD_DRY_RUN",
+		Usage:  "Print the resolved plan of tags, Dockerfile and commands without executing anything",
+	}
+
+	PlanFormatFlag = cli.StringFlag{
+		Name:   "plan-format",
+		Value:  "text",
+		EnvVar: "GTD_PLAN_FORMAT",
+		Usage:  "Dry run plan format, text or json",
+	}
+
 	VerboseFlag = cli.BoolFlag{
 		Name:  "verbose",
 		Usage: "Print debug info",
@@ -109,18 +160,62 @@ var (
 	GoPathFlag = cli.StringFlag{
 		Name:   "gopath",
 		EnvVar: "GOPATH",
+		Usage:  "GOPATH mounted into builder image, only used by non go module projects",
+	}
+
+	ModCacheFlag = cli.StringFlag{
+		Name:   "mod-cache",
+		EnvVar: "GTD_MOD_CACHE",
+		Usage:  "Host dir or docker volume for go module cache (default: \"go-to-docker-gomod\" volume)",
+	}
+
+	EngineFlag = cli.StringFlag{
+		Name:   "engine",
+		EnvVar: "GTD_ENGINE",
+		Usage:  "Build images by docker or native, native assembles images without a docker daemon (default: \"docker\")",
+	}
+
+	HermeticFlag = cli.BoolFlag{
+		Name:   "hermetic",
+		EnvVar: "GTD_HERMETIC",
+		Usage:  "Build app and image by one multi-stage docker build with source as build context, without host bind mounts",
+	}
+
+	ArchiveFlag = cli.StringFlag{
+		Name:   "archive",
+		EnvVar: "GTD_ARCHIVE",
+		Usage:  "Image archive path, a docker-archive tarball or an OCI layout (default: \"<name>-image.tar\" or \"<name>-image.oci\" in workdir when saving)",
+	}
+
+	ImageFormatFlag = cli.StringFlag{
+		Name:   "image-format",
+		EnvVar: "GTD_IMAGE_FORMAT",
+		Usage:  "Format of images assembled by native engine, oci or docker-archive (default: \"oci\")",
 	}
 )
 
 var (
+	GlobalFlags = []cli.Flag{
+		ConfigFlag,
+		DryRunFlag,
+		PlanFormatFlag,
+	}
+
 	BuildAppFlags = []cli.Flag{
 		AppNameFlag,
 		WorkDirFlag,
 		BuilderImageFlag,
 		BuilderImageUserFlag,
+		PlatformFlag,
+		LDFlagsVarFlag,
+		TagFlag,
+		ReleaseLatestFlag,
+		BranchTagsConfigFlag,
+		FakeRevisionBranch,
 		ResFlag,
 		VerboseFlag,
 		GoPathFlag,
+		ModCacheFlag,
 	}
 
 	BuildImageFlags = []cli.Flag{
@@ -129,7 +224,11 @@ var (
 		RegistryFlag,
 		OrgFlag,
 		TagFlag,
+		ReleaseLatestFlag,
+		PlatformFlag,
 		ExposeFlag,
+		ArgsFlag,
+		LabelFlag,
 		AppImageFlag,
 		AppImageUserFlag,
 		TemplateFlag,
@@ -138,6 +237,12 @@ var (
 		FakeRevisionBranch,
 		VerboseFlag,
 		GoPathFlag,
+		EngineFlag,
+		ImageFormatFlag,
+		HermeticFlag,
+		BuilderImageFlag,
+		LDFlagsVarFlag,
+		ResFlag,
 	}
 
 	BuildAllFlags = joinFlags(BuildAppFlags, BuildImageFlags)
@@ -148,9 +253,13 @@ var (
 		RegistryFlag,
 		OrgFlag,
 		TagFlag,
+		ReleaseLatestFlag,
+		PlatformFlag,
 		BranchTagsConfigFlag,
 		FakeRevisionBranch,
 		VerboseFlag,
+		EngineFlag,
+		ImageFormatFlag,
 	}
 
 	PushTriggerFlags = []cli.Flag{
@@ -173,10 +282,40 @@ var (
 		RegistryFlag,
 		OrgFlag,
 		TagFlag,
+		ReleaseLatestFlag,
+		PlatformFlag,
 		VerboseFlag,
+		EngineFlag,
+		ImageFormatFlag,
 	}
 
 	ClearAllFlags = joinFlags(ClearAppFlags, ClearImageFlags)
+
+	SaveImageFlags = []cli.Flag{
+		AppNameFlag,
+		WorkDirFlag,
+		RegistryFlag,
+		OrgFlag,
+		TagFlag,
+		ReleaseLatestFlag,
+		PlatformFlag,
+		BranchTagsConfigFlag,
+		FakeRevisionBranch,
+		VerboseFlag,
+		EngineFlag,
+		ImageFormatFlag,
+		ArchiveFlag,
+	}
+
+	LoadImageFlags = []cli.Flag{
+		ArchiveFlag,
+		WorkDirFlag,
+		RegistryFlag,
+		OrgFlag,
+		VerboseFlag,
+	}
+
+	PushArchiveFlags = LoadImageFlags
 )
 
 func joinFlags(a, b []cli.Flag) []cli.Flag {
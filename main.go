@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -14,6 +15,9 @@ import (
 
 var (
 	logger = logrus_mate.Logger()
+
+	// plan is shared by all builders of a dry run
+	plan *builder.Plan
 )
 
 func main() {
@@ -23,6 +27,10 @@ func main() {
 	app.Usage = "a tool for build your app and push images to docker registry"
 	app.HelpName = "go-to-docker"
 
+	app.Flags = GlobalFlags
+	app.Before = beforeDryRun
+	app.After = printDryRunPlan
+
 	app.Commands = []cli.Command{
 		{
 			Name:  "build",
@@ -64,6 +72,12 @@ func main() {
 					Action: cmdPushTrigger,
 					Flags:  PushTriggerFlags,
 				},
+				{
+					Name:   "archive",
+					Usage:  "push images of an archive to docker registry without docker",
+					Action: cmdPushArchive,
+					Flags:  PushArchiveFlags,
+				},
 				{
 					Name:   "all",
 					Usage:  "push image and trigger",
@@ -78,6 +92,42 @@ func main() {
 			Action: cmdAll,
 			Flags:  AllFlags,
 		},
+		{
+			Name:  "save",
+			Usage: "Save images to an archive",
+			Subcommands: []cli.Command{
+				{
+					Name:   "image",
+					Usage:  "save images of all tags as a docker-archive tarball or an OCI layout",
+					Action: cmdSaveImage,
+					Flags:  SaveImageFlags,
+				},
+			},
+		},
+		{
+			Name:  "load",
+			Usage: "Load images from an archive",
+			Subcommands: []cli.Command{
+				{
+					Name:   "image",
+					Usage:  "load images of a docker-archive tarball or an OCI layout into docker",
+					Action: cmdLoadImage,
+					Flags:  LoadImageFlags,
+				},
+			},
+		},
+		{
+			Name:  "render",
+			Usage: "Render files of build without building",
+			Subcommands: []cli.Command{
+				{
+					Name:   "dockerfile",
+					Usage:  "Print the Dockerfile rendered from template",
+					Action: cmdRenderDockerfile,
+					Flags:  BuildImageFlags,
+				},
+			},
+		},
 		{
 			Name:  "clear",
 			Usage: "Clear app's build output and image",
@@ -111,41 +161,43 @@ func main() {
 
 func cmdBuildApp(c *cli.Context) (err error) {
 
-	appName := c.String("name")
-	workdir := c.String("workdir")
-	image := c.String("builder-image")
-	user := c.String("builder-image-user")
-
-	resources := c.StringSlice("res")
-	verbose := c.Bool("verbose")
-	gopath := c.String("gopath")
-
-	if len(gopath) == 0 {
-		gopath = os.Getenv("GOPATH")
+	var opts *optionReader
+	if opts, err = newOptionReader(c); err != nil {
+		return
 	}
 
-	if err = os.Setenv("GOPATH", gopath); err != nil {
+	var ldflagsVars map[string]string
+	if ldflagsVars, err = opts.LDFlagsVars(); err != nil {
 		return
 	}
 
-	if appName == "" {
-		appName = getDefaultAppName(workdir)
+	var branchTagsConfig builder.BranchTagsConfig
+	if branchTagsConfig, err = opts.BranchTagsConfig(); err != nil {
+		return
 	}
 
 	bder := &builder.Builder{
+		Plan: plan,
 		Options: builder.BuildOptions{
-			Verbose:          verbose,
-			BuilderImage:     image,
+			Verbose:          opts.Bool("verbose", opts.file.Verbose),
+			BuilderImage:     opts.String("builder-image", opts.file.BuilderImage),
 			AppImage:         "",
-			WorkDir:          workdir,
-			AppName:          appName,
+			WorkDir:          opts.workdir,
+			AppName:          opts.AppName(),
 			DockerfileTmpl:   "",
-			AppImageTags:     nil,
+			AppImageTags:     opts.StringSlice("tag", opts.file.Tags),
+			ReleaseLatest:    opts.Bool("release-latest", opts.file.ReleaseLatest),
+			BuildOutputDir:   opts.file.BuildOutputDir,
 			Exposes:          nil,
 			AppArgs:          nil,
-			Resources:        resources,
-			BuilderImageUser: user,
-			GoPath:           gopath,
+			Resources:        opts.StringSlice("res", opts.file.Resources),
+			BuilderImageUser: opts.String("builder-image-user", opts.file.BuilderImageUser),
+			GoPath:           opts.String("gopath", opts.file.GoPath),
+			ModCache:         opts.String("mod-cache", opts.file.ModCache),
+			Platforms:        opts.StringSlice("platform", opts.file.Platforms),
+			LDFlagsVars:      ldflagsVars,
+			BranchTagsConfig: branchTagsConfig,
+			RevisionBranch:   opts.String("fake-branch", opts.file.FakeBranch),
 		},
 	}
 
@@ -158,66 +210,109 @@ func cmdBuildApp(c *cli.Context) (err error) {
 
 func cmdBuildImage(c *cli.Context) (err error) {
 
-	appName := c.String("name")
-	workdir := c.String("workdir")
-	image := c.String("app-image")
-	user := c.String("app-image-user")
-	registry := c.String("registry")
-	organization := c.String("organization")
-	tag := c.StringSlice("tag")
-	template := c.String("template")
-	expose := c.StringSlice("expose")
-	branchTagConfigFilename := c.String("branch-tags-config")
-	fakeBranchName := c.String("fake-branch")
-	verbose := c.Bool("verbose")
+	var bder *builder.Builder
+	if bder, err = newImageBuilder(c); err != nil {
+		return
+	}
+
+	if err = bder.BuildImage(); err != nil {
+		return
+	}
+
+	return
+}
+
+func cmdRenderDockerfile(c *cli.Context) (err error) {
+
+	var bder *builder.Builder
+	if bder, err = newImageBuilder(c); err != nil {
+		return
+	}
 
-	if appName == "" {
-		appName = getDefaultAppName(workdir)
+	if err = bder.RenderDockerfile(os.Stdout); err != nil {
+		return
+	}
+
+	return
+}
+
+// newImageBuilder returns the builder of build image and render dockerfile
+func newImageBuilder(c *cli.Context) (bder *builder.Builder, err error) {
+
+	var opts *optionReader
+	if opts, err = newOptionReader(c); err != nil {
+		return
+	}
+
+	var appArgs map[string]string
+	if appArgs, err = opts.AppArgs(); err != nil {
+		return
+	}
+
+	var labels map[string]string
+	if labels, err = opts.Labels(); err != nil {
+		return
+	}
+
+	// hermetic builds compile the app in the builder stage
+	var ldflagsVars map[string]string
+	if ldflagsVars, err = opts.LDFlagsVars(); err != nil {
+		return
 	}
 
 	var branchTagsConfig builder.BranchTagsConfig
-	if len(branchTagConfigFilename) > 0 {
-		if branchTagsConfig, err = loadBranchTagConfig(branchTagConfigFilename); err != nil {
-			return
-		}
+	if branchTagsConfig, err = opts.BranchTagsConfig(); err != nil {
+		return
 	}
 
-	bder := &builder.Builder{
+	bder = &builder.Builder{
+		Plan: plan,
 		Options: builder.BuildOptions{
-			Verbose:          verbose,
-			BuilderImage:     "",
-			AppImage:         image,
-			AppImageUser:     user,
-			WorkDir:          workdir,
-			AppName:          appName,
-			RegistryHost:     registry,
-			RegistryOrg:      organization,
-			AppImageTags:     tag,
-			DockerfileTmpl:   template,
-			Exposes:          expose,
-			AppArgs:          nil,
-			Resources:        nil,
+			Verbose:          opts.Bool("verbose", opts.file.Verbose),
+			BuilderImage:     opts.String("builder-image", opts.file.BuilderImage),
+			AppImage:         opts.String("app-image", opts.file.AppImage),
+			AppImageUser:     opts.String("app-image-user", opts.file.AppImageUser),
+			WorkDir:          opts.workdir,
+			AppName:          opts.AppName(),
+			RegistryHost:     opts.String("registry", opts.file.Registry),
+			RegistryOrg:      opts.String("organization", opts.file.Organization),
+			RegistryUsername: opts.file.Username,
+			RegistryPassword: opts.file.Password,
+			AppImageTags:     opts.StringSlice("tag", opts.file.Tags),
+			ReleaseLatest:    opts.Bool("release-latest", opts.file.ReleaseLatest),
+			BuildOutputDir:   opts.file.BuildOutputDir,
+			DockerfileTmpl:   opts.String("template", opts.file.DockerfileTmpl),
+			Exposes:          opts.StringSlice("expose", opts.file.Exposes),
+			AppArgs:          appArgs,
+			Resources:        opts.StringSlice("res", opts.file.Resources),
 			BranchTagsConfig: branchTagsConfig,
-			RevisionBranch:   fakeBranchName,
+			RevisionBranch:   opts.String("fake-branch", opts.file.FakeBranch),
+			Platforms:        opts.StringSlice("platform", opts.file.Platforms),
+			Engine:           opts.String("engine", opts.file.Engine),
+			ImageFormat:      opts.String("image-format", opts.file.ImageFormat),
+			Hermetic:         opts.Bool("hermetic", opts.file.Hermetic),
+			GoPath:           opts.String("gopath", opts.file.GoPath),
+			LDFlagsVars:      ldflagsVars,
+			Labels:           labels,
 		},
 	}
 
-	if err = bder.BuildImage(); err != nil {
-		return
-	}
-
 	return
 }
 
 func cmdClearApp(c *cli.Context) (err error) {
 
-	workdir := c.String("workdir")
-	verbose := c.Bool("verbose")
+	var opts *optionReader
+	if opts, err = newOptionReader(c); err != nil {
+		return
+	}
 
 	bder := &builder.Builder{
+		Plan: plan,
 		Options: builder.BuildOptions{
-			Verbose: verbose,
-			WorkDir: workdir,
+			Verbose:        opts.Bool("verbose", opts.file.Verbose),
+			WorkDir:        opts.workdir,
+			BuildOutputDir: opts.file.BuildOutputDir,
 		},
 	}
 
@@ -230,26 +325,26 @@ func cmdClearApp(c *cli.Context) (err error) {
 
 func cmdClearImage(c *cli.Context) (err error) {
 
-	verbose := c.Bool("verbose")
-	appName := c.String("name")
-	tag := c.StringSlice("tag")
-	registry := c.String("registry")
-	organization := c.String("organization")
-	workdir := c.String("workdir")
-	fakeBranchName := c.String("fake-branch")
-
-	if appName == "" {
-		appName = getDefaultAppName(workdir)
+	var opts *optionReader
+	if opts, err = newOptionReader(c); err != nil {
+		return
 	}
 
 	bder := &builder.Builder{
+		Plan: plan,
 		Options: builder.BuildOptions{
-			Verbose:        verbose,
-			AppImageTags:   tag,
-			AppName:        appName,
-			RegistryHost:   registry,
-			RegistryOrg:    organization,
-			RevisionBranch: fakeBranchName,
+			Verbose:        opts.Bool("verbose", opts.file.Verbose),
+			WorkDir:        opts.workdir,
+			AppImageTags:   opts.StringSlice("tag", opts.file.Tags),
+			ReleaseLatest:  opts.Bool("release-latest", opts.file.ReleaseLatest),
+			AppName:        opts.AppName(),
+			RegistryHost:   opts.String("registry", opts.file.Registry),
+			RegistryOrg:    opts.String("organization", opts.file.Organization),
+			BuildOutputDir: opts.file.BuildOutputDir,
+			RevisionBranch: opts.String("fake-branch", opts.file.FakeBranch),
+			Platforms:      opts.StringSlice("platform", opts.file.Platforms),
+			Engine:         opts.String("engine", opts.file.Engine),
+			ImageFormat:    opts.String("image-format", opts.file.ImageFormat),
 		},
 	}
 
@@ -274,37 +369,36 @@ func cmdClearAll(c *cli.Context) (err error) {
 }
 
 func cmdPushImage(c *cli.Context) (err error) {
-	verbose := c.Bool("verbose")
-	appName := c.String("name")
-	tag := c.StringSlice("tag")
-	registry := c.String("registry")
-	organization := c.String("organization")
-	workdir := c.String("workdir")
-	dockerInDockerUser := c.String("dind-user")
-	branchTagConfigFilename := c.String("branch-tags-config")
-	fakeBranchName := c.String("fake-branch")
 
-	if appName == "" {
-		appName = getDefaultAppName(workdir)
+	var opts *optionReader
+	if opts, err = newOptionReader(c); err != nil {
+		return
 	}
 
 	var branchTagsConfig builder.BranchTagsConfig
-	if len(branchTagConfigFilename) > 0 {
-		if branchTagsConfig, err = loadBranchTagConfig(branchTagConfigFilename); err != nil {
-			return
-		}
+	if branchTagsConfig, err = opts.BranchTagsConfig(); err != nil {
+		return
 	}
 
 	bder := &builder.Builder{
+		Plan: plan,
 		Options: builder.BuildOptions{
-			Verbose:            verbose,
-			AppImageTags:       tag,
-			AppName:            appName,
-			RegistryHost:       registry,
-			RegistryOrg:        organization,
+			Verbose:            opts.Bool("verbose", opts.file.Verbose),
+			WorkDir:            opts.workdir,
+			AppImageTags:       opts.StringSlice("tag", opts.file.Tags),
+			ReleaseLatest:      opts.Bool("release-latest", opts.file.ReleaseLatest),
+			AppName:            opts.AppName(),
+			RegistryHost:       opts.String("registry", opts.file.Registry),
+			RegistryOrg:        opts.String("organization", opts.file.Organization),
+			RegistryUsername:   opts.file.Username,
+			RegistryPassword:   opts.file.Password,
+			BuildOutputDir:     opts.file.BuildOutputDir,
 			BranchTagsConfig:   branchTagsConfig,
-			DockerInDockerUser: dockerInDockerUser,
-			RevisionBranch:     fakeBranchName,
+			DockerInDockerUser: opts.String("dind-user", opts.file.DockerInDockerUser),
+			RevisionBranch:     opts.String("fake-branch", opts.file.FakeBranch),
+			Platforms:          opts.StringSlice("platform", opts.file.Platforms),
+			Engine:             opts.String("engine", opts.file.Engine),
+			ImageFormat:        opts.String("image-format", opts.file.ImageFormat),
 		},
 	}
 
@@ -315,14 +409,110 @@ func cmdPushImage(c *cli.Context) (err error) {
 	return
 }
 
+func cmdSaveImage(c *cli.Context) (err error) {
+
+	var opts *optionReader
+	if opts, err = newOptionReader(c); err != nil {
+		return
+	}
+
+	var branchTagsConfig builder.BranchTagsConfig
+	if branchTagsConfig, err = opts.BranchTagsConfig(); err != nil {
+		return
+	}
+
+	bder := &builder.Builder{
+		Plan: plan,
+		Options: builder.BuildOptions{
+			Verbose:          opts.Bool("verbose", opts.file.Verbose),
+			WorkDir:          opts.workdir,
+			AppImageTags:     opts.StringSlice("tag", opts.file.Tags),
+			ReleaseLatest:    opts.Bool("release-latest", opts.file.ReleaseLatest),
+			AppName:          opts.AppName(),
+			RegistryHost:     opts.String("registry", opts.file.Registry),
+			RegistryOrg:      opts.String("organization", opts.file.Organization),
+			BuildOutputDir:   opts.file.BuildOutputDir,
+			BranchTagsConfig: branchTagsConfig,
+			RevisionBranch:   opts.String("fake-branch", opts.file.FakeBranch),
+			Platforms:        opts.StringSlice("platform", opts.file.Platforms),
+			Engine:           opts.String("engine", opts.file.Engine),
+			ImageFormat:      opts.String("image-format", opts.file.ImageFormat),
+			ArchivePath:      opts.String("archive", ""),
+		},
+	}
+
+	if err = bder.SaveImage(); err != nil {
+		return
+	}
+
+	return
+}
+
+func cmdLoadImage(c *cli.Context) (err error) {
+
+	var opts *optionReader
+	if opts, err = newOptionReader(c); err != nil {
+		return
+	}
+
+	bder := &builder.Builder{
+		Plan: plan,
+		Options: builder.BuildOptions{
+			Verbose:      opts.Bool("verbose", opts.file.Verbose),
+			WorkDir:      opts.workdir,
+			RegistryHost: opts.String("registry", opts.file.Registry),
+			RegistryOrg:  opts.String("organization", opts.file.Organization),
+			ArchivePath:  opts.String("archive", ""),
+		},
+	}
+
+	if err = bder.LoadImage(); err != nil {
+		return
+	}
+
+	return
+}
+
+func cmdPushArchive(c *cli.Context) (err error) {
+
+	var opts *optionReader
+	if opts, err = newOptionReader(c); err != nil {
+		return
+	}
+
+	bder := &builder.Builder{
+		Plan: plan,
+		Options: builder.BuildOptions{
+			Verbose:          opts.Bool("verbose", opts.file.Verbose),
+			WorkDir:          opts.workdir,
+			RegistryHost:     opts.String("registry", opts.file.Registry),
+			RegistryOrg:      opts.String("organization", opts.file.Organization),
+			RegistryUsername: opts.file.Username,
+			RegistryPassword: opts.file.Password,
+			ArchivePath:      opts.String("archive", ""),
+		},
+	}
+
+	if err = bder.PushArchive(); err != nil {
+		return
+	}
+
+	return
+}
+
 func cmdPushTrigger(c *cli.Context) (err error) {
-	uri := c.StringSlice("uri")
-	verbose := c.Bool("verbose")
+
+	var opts *optionReader
+	if opts, err = newOptionReader(c); err != nil {
+		return
+	}
 
 	bder := &builder.Builder{
+		Plan: plan,
 		Options: builder.BuildOptions{
-			Verbose:     verbose,
-			TriggerURIs: uri,
+			Verbose:     opts.Bool("verbose", opts.file.Verbose),
+			WorkDir:     opts.workdir,
+			TriggerURIs: opts.StringSlice("uri", opts.file.TriggerURIs),
 		},
 	}
 
@@ -346,7 +536,7 @@ func cmdPushAll(c *cli.Context) (err error) {
 }
 
 func cmdBuildAll(c *cli.Context) (err error) {
-	if err = cmdBuildApp(c); err != nil {
+	if err = cmdBuildAppUnlessHermetic(c); err != nil {
 		return
 	}
 
@@ -358,7 +548,7 @@ func cmdBuildAll(c *cli.Context) (err error) {
 }
 
 func cmdAll(c *cli.Context) (err error) {
-	if err = cmdBuildApp(c); err != nil {
+	if err = cmdBuildAppUnlessHermetic(c); err != nil {
 		return
 	}
 
@@ -377,6 +567,46 @@ func cmdAll(c *cli.Context) (err error) {
 	return
 }
 
+// cmdBuildAppUnlessHermetic builds app, hermetic builds compile the app while
+// building image
+func cmdBuildAppUnlessHermetic(c *cli.Context) (err error) {
+	var opts *optionReader
+	if opts, err = newOptionReader(c); err != nil {
+		return
+	}
+
+	if opts.Bool("hermetic", opts.file.Hermetic) {
+		return
+	}
+
+	return cmdBuildApp(c)
+}
+
+func beforeDryRun(c *cli.Context) (err error) {
+	if c.GlobalBool("dry-run") {
+		plan = &builder.Plan{}
+	}
+
+	return
+}
+
+func printDryRunPlan(c *cli.Context) (err error) {
+	if plan == nil {
+		return
+	}
+
+	switch format := c.GlobalString("plan-format"); format {
+	case "", "text":
+		err = plan.Print(os.Stdout, false)
+	case "json":
+		err = plan.Print(os.Stdout, true)
+	default:
+		err = fmt.Errorf("unknown plan format: %s", format)
+	}
+
+	return
+}
+
 func getDefaultAppName(cwd string) (name string) {
 	if cwd == "" {
 		name = "app"
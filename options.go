@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gogap/go-to-docker/builder"
+	"github.com/urfave/cli"
+)
+
+// optionReader reads command options by the precedence of
+// flag > env > project config file > flag default value
+type optionReader struct {
+	c       *cli.Context
+	file    builder.ProjectConfig
+	workdir string
+}
+
+func newOptionReader(c *cli.Context) (r *optionReader, err error) {
+	r = &optionReader{c: c, workdir: c.String("workdir")}
+
+	if r.workdir == "" {
+		if r.workdir, err = os.Getwd(); err != nil {
+			return
+		}
+	}
+
+	filename := c.GlobalString("config")
+	if len(filename) == 0 {
+		if filename, err = builder.FindProjectConfig(r.workdir); err != nil {
+			return
+		}
+	}
+
+	if len(filename) == 0 {
+		return
+	}
+
+	logger.Debugf("using project config of %s", filename)
+
+	if r.file, err = builder.LoadProjectConfig(filename); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *optionReader) String(name string, fileValue string) string {
+	if p.c.IsSet(name) || len(fileValue) == 0 {
+		return p.c.String(name)
+	}
+	return fileValue
+}
+
+func (p *optionReader) StringSlice(name string, fileValue []string) []string {
+	if p.c.IsSet(name) || len(fileValue) == 0 {
+		return p.c.StringSlice(name)
+	}
+	return fileValue
+}
+
+func (p *optionReader) Bool(name string, fileValue bool) bool {
+	if p.c.IsSet(name) {
+		return p.c.Bool(name)
+	}
+	return fileValue
+}
+
+func (p *optionReader) AppName() string {
+	appName := p.String("name", p.file.AppName)
+	if appName == "" {
+		appName = getDefaultAppName(p.workdir)
+	}
+	return appName
+}
+
+// AppArgs parses the --args JSON object, its keys override the args of
+// project config
+func (p *optionReader) AppArgs() (args map[string]string, err error) {
+	value := p.c.String("args")
+	if len(value) == 0 {
+		return p.file.Args, nil
+	}
+
+	var flagArgs map[string]string
+	if err = json.Unmarshal([]byte(value), &flagArgs); err != nil {
+		err = fmt.Errorf("parse --args failure, it should be a JSON object of strings, e.g: {\"key\":\"value\"}: %s", err)
+		return
+	}
+
+	args = map[string]string{}
+	for k, v := range p.file.Args {
+		args[k] = v
+	}
+	for k, v := range flagArgs {
+		args[k] = v
+	}
+
+	return
+}
+
+func (p *optionReader) LDFlagsVars() (map[string]string, error) {
+	return builder.ParseLDFlagsVars(p.StringSlice("ldflags-var", p.file.LDFlagsVarValues())...)
+}
+
+// Labels parses the --label values, or the labels of project config
+func (p *optionReader) Labels() (map[string]string, error) {
+	return builder.ParseLabels(p.StringSlice("label", p.file.LabelValues())...)
+}
+
+// BranchTagsConfig loads the --branch-tags-config file, or the branch config
+// file or inline branchs of project config
+func (p *optionReader) BranchTagsConfig() (config builder.BranchTagsConfig, err error) {
+	filename := p.c.String("branch-tags-config")
+
+	if !p.c.IsSet("branch-tags-config") && len(p.file.BranchTagsConfig) > 0 {
+		filename = p.file.BranchTagsConfig
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(p.workdir, filename)
+		}
+	}
+
+	if len(filename) > 0 {
+		return loadBranchTagConfig(filename)
+	}
+
+	config.Branchs = p.file.Branchs
+
+	return
+}